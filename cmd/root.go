@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/zapier/prom-aggregation-gateway/config"
@@ -23,6 +24,42 @@ func Execute() {
 	rootCmd.SilenceUsage = true
 
 	rootCmd.PersistentFlags().StringSliceVar(&cfg.AuthUsers, "AuthUsers", []string{}, "List of allowed auth users and their passwords comma separated\n Example: \"user1=pass1,user2=pass2\"")
+	rootCmd.PersistentFlags().StringVar(&cfg.AuthHtpasswd, "authHtpasswd", "", "Path to an htpasswd file of allowed auth users with bcrypt or {SHA} hashed passwords, reloaded when it changes")
+	rootCmd.PersistentFlags().StringVar(&cfg.AuthTokens, "authTokens", "", "Path to a YAML file of bearer tokens / API keys, each scoped to operations, jobs and metric prefixes")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.ReadAuthUsers, "readAuthUsers", []string{}, "List of users allowed to read GET /metrics and their passwords comma separated\n Example: \"prometheus=pass1\"")
+	rootCmd.PersistentFlags().StringVar(&cfg.ReadHtpasswd, "readAuthHtpasswd", "", "Path to an htpasswd file of users allowed to read GET /metrics")
+	rootCmd.PersistentFlags().BoolVar(&cfg.ReadAuth, "readAuthRequired", false, "Require authentication on GET /metrics, by read users or tokens with the read scope")
+	rootCmd.PersistentFlags().StringVar(&cfg.JWTKeySet, "jwtKeySet", "", "Path to a JWKS file used to verify JWTs sent as bearer tokens")
+	rootCmd.PersistentFlags().StringVar(&cfg.JWTKey, "jwtKey", "", "Path to a PEM public key or HMAC secret used to verify JWTs sent as bearer tokens")
+	rootCmd.PersistentFlags().StringVar(&cfg.JWTIssuer, "jwtIssuer", "", "Required 'iss' claim of JWTs")
+	rootCmd.PersistentFlags().StringVar(&cfg.JWTAudience, "jwtAudience", "", "Required 'aud' claim of JWTs")
+	rootCmd.PersistentFlags().StringVar(&cfg.JWTIdentity, "jwtIdentityClaim", "sub", "JWT claim identifying the client")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.JWTClaimLabels, "jwtClaimLabels", []string{}, "JWT claims added as labels to pushed metrics comma separated\n Example: \"tenant=tenant,app_id=app\"")
+	rootCmd.PersistentFlags().StringVar(&cfg.RateLimitKey, "rateLimitKey", "ip", "What push rate limits are applied per: ip, identity or job")
+	rootCmd.PersistentFlags().Float64Var(&cfg.RateLimit, "rateLimit", 0, "Pushes per second allowed per client, 0 disables rate limiting")
+	rootCmd.PersistentFlags().IntVar(&cfg.RateLimitBurst, "rateLimitBurst", 0, "Pushes a client may burst above the rate limit, defaults to the rate")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.RateLimitOverrides, "rateLimitOverrides", []string{}, "Per client rate limits overriding the default, as key=rate or key=rate:burst comma separated\n Example: \"ci=100:200,browser=0.5\"")
+	rootCmd.PersistentFlags().Int64Var(&cfg.MaxBodyBytes, "maxBodyBytes", 0, "Largest push body accepted in bytes, 0 for no limit")
+	rootCmd.PersistentFlags().Int64Var(&cfg.MaxDecompressed, "maxDecompressedBytes", 0, "Largest compressed push body accepted once decompressed in bytes, 0 for the default of 64MiB")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxFamilies, "maxFamiliesPerPush", 0, "Most metric families accepted in a single push, 0 for no limit")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxSeries, "maxSeriesPerPush", 0, "Most series accepted in a single push, 0 for no limit")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxLabels, "maxLabels", 0, "Most labels accepted on a pushed series, including path labels, 0 for no limit")
+	rootCmd.PersistentFlags().IntVar(&cfg.MaxLabelValueLength, "maxLabelValueLength", 0, "Longest label value accepted in bytes, 0 for no limit")
+	rootCmd.PersistentFlags().BoolVar(&cfg.PartialPushes, "partialPushes", false, "Apply the valid families of a push and report the rejected ones as JSON, instead of rejecting the whole push")
+	rootCmd.PersistentFlags().StringVar(&cfg.TypeConflictPolicy, "typeConflictPolicy", "reject", "What to do with a family pushed with a different type than the one stored: reject, replace, keep_both (stored as <name>_<type>) or coerce_untyped")
+	rootCmd.PersistentFlags().BoolVar(&cfg.PutReplaces, "putReplaces", false, "Make PUT replace every series carrying the labels in the path, like the pushgateway, instead of adding to them like POST")
+	rootCmd.PersistentFlags().DurationVar(&cfg.IdempotencyTTL, "idempotencyTTL", 5*time.Minute, "How long the Idempotency-Key header of a push is remembered, so retries aren't merged twice, 0 disables it")
+	rootCmd.PersistentFlags().IntVar(&cfg.IdempotencyMaxKeys, "idempotencyMaxKeys", 10000, "Most idempotency keys remembered at once, forgetting the oldest first")
+	rootCmd.PersistentFlags().StringVar(&cfg.LabelConflictPolicy, "labelConflictPolicy", "reject", "What to do with a label from the path that is also on a pushed series: reject the push, let the path or the series value win, or rename the series label to exported_<name>\n One of: reject, path, body, rename")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.QueryLabels, "queryLabels", []string{}, "Labels pushes may set with query parameters comma separated\n Example: \"app,app_version\"")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.HeaderLabels, "headerLabels", []string{}, "Request headers that set labels on pushes, as header=label comma separated\n Example: \"X-App-Version=app_version\"")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.Enrich, "enrich", []string{}, "Labels worked out by the server and added to every push, as enricher=label or enricher=label:value|value to limit their values, comma separated. Enrichers are geoip_country, user_agent_family, user_agent_os and identity\n Example: \"geoip_country=country:US|DE|FR,user_agent_family=browser\"")
+	rootCmd.PersistentFlags().IntVar(&cfg.IngestQueueSize, "ingestQueueSize", 0, "Most validated pushes waiting to be merged by background workers, answering pushes once queued and with 503 when full, 0 merges pushes before answering")
+	rootCmd.PersistentFlags().IntVar(&cfg.IngestWorkers, "ingestWorkers", 4, "Number of workers merging queued pushes when the ingest queue is enabled")
+	rootCmd.PersistentFlags().Int64Var(&cfg.MemorySoftLimit, "memorySoftLimitBytes", 0, "Approximate bytes stored series may use before pushes adding series are rejected with 507, while existing series are still updated, 0 for no limit")
+	rootCmd.PersistentFlags().Int64Var(&cfg.MemoryHardLimit, "memoryHardLimitBytes", 0, "Approximate bytes stored series may use before the least recently updated series are evicted, 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&cfg.GeoIPDatabase, "geoipDatabase", "", "Path to a MaxMind format database, such as GeoLite2-Country, used by the geoip_country enricher")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.TrustedProxies, "trustedProxies", []string{}, "IPs or CIDRs of proxies trusted to set X-Forwarded-For and X-Real-IP, used for client IPs by rate limiting and geoip_country, comma separated. Without any, the address of the connection is used\n Example: \"10.0.0.0/8,192.168.1.1\"")
 	rootCmd.PersistentFlags().StringVar(&cfg.ApiListen, "apiListen", ":80", "Listen for API requests on this host/port.")
 	rootCmd.PersistentFlags().StringVar(&cfg.LifecycleListen, "lifecycleListen", ":8888", "Listen for lifecycle requests (health, metrics) on this host/port")
 	rootCmd.PersistentFlags().StringVar(&cfg.CorsDomain, "cors", "*", "The 'Access-Control-Allow-Origin' value to be returned.")
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
 	"github.com/zapier/prom-aggregation-gateway/routers"
 )
 
@@ -17,10 +18,70 @@ var startCmd = &cobra.Command{
 }
 
 func startFunc(cmd *cobra.Command, args []string) error {
+	typeConflictPolicy, err := metrics.ParseTypeConflictPolicy(cfg.TypeConflictPolicy)
+	if err != nil {
+		return err
+	}
+	labelConflictPolicy, err := metrics.ParseLabelConflictPolicy(cfg.LabelConflictPolicy)
+	if err != nil {
+		return err
+	}
+	if err := metrics.ValidateQueryLabels(cfg.QueryLabels); err != nil {
+		return err
+	}
+	headerLabels, err := metrics.ParseHeaderLabels(cfg.HeaderLabels)
+	if err != nil {
+		return err
+	}
+	enrichments, err := metrics.ParseEnrichments(cfg.Enrich, cfg.GeoIPDatabase)
+	if err != nil {
+		return err
+	}
 
 	apiCfg := routers.ApiRouterConfig{
-		CorsDomain: cfg.CorsDomain,
-		Accounts:   cfg.AuthUsers,
+		CorsDomain:       cfg.CorsDomain,
+		Accounts:         cfg.AuthUsers,
+		HtpasswdFile:     cfg.AuthHtpasswd,
+		TokensFile:       cfg.AuthTokens,
+		ReadAccounts:     cfg.ReadAuthUsers,
+		ReadHtpasswdFile: cfg.ReadHtpasswd,
+		RequireReadAuth:  cfg.ReadAuth,
+		PushLimits: metrics.PushLimits{
+			MaxBodyBytes:         cfg.MaxBodyBytes,
+			MaxDecompressedBytes: cfg.MaxDecompressed,
+			MaxFamilies:          cfg.MaxFamilies,
+			MaxSeries:            cfg.MaxSeries,
+			MaxLabels:            cfg.MaxLabels,
+			MaxLabelValueLength:  cfg.MaxLabelValueLength,
+		},
+		PartialPushes:       cfg.PartialPushes,
+		TypeConflictPolicy:  typeConflictPolicy,
+		PutReplaces:         cfg.PutReplaces,
+		IdempotencyTTL:      cfg.IdempotencyTTL,
+		IdempotencyMaxKeys:  cfg.IdempotencyMaxKeys,
+		LabelConflictPolicy: labelConflictPolicy,
+		QueryLabels:         cfg.QueryLabels,
+		HeaderLabels:        headerLabels,
+		Enrichments:         enrichments,
+		IngestQueueSize:     cfg.IngestQueueSize,
+		IngestWorkers:       cfg.IngestWorkers,
+		MemorySoftLimit:     cfg.MemorySoftLimit,
+		MemoryHardLimit:     cfg.MemoryHardLimit,
+		TrustedProxies:      cfg.TrustedProxies,
+		RateLimit: routers.RateLimitConfig{
+			Key:       cfg.RateLimitKey,
+			Rate:      cfg.RateLimit,
+			Burst:     cfg.RateLimitBurst,
+			Overrides: cfg.RateLimitOverrides,
+		},
+		JWT: routers.JWTConfig{
+			JWKSFile:      cfg.JWTKeySet,
+			KeyFile:       cfg.JWTKey,
+			Issuer:        cfg.JWTIssuer,
+			Audience:      cfg.JWTAudience,
+			IdentityClaim: cfg.JWTIdentity,
+			ClaimLabels:   cfg.JWTClaimLabels,
+		},
 	}
 
 	routers.RunServers(apiCfg, cfg.ApiListen, cfg.LifecycleListen)
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -20,6 +21,45 @@ type Server struct {
 	LifecycleListen string
 	CorsDomain      string
 	AuthUsers       []string
+	AuthHtpasswd    string
+	AuthTokens      string
+	ReadAuthUsers   []string
+	ReadHtpasswd    string
+	ReadAuth        bool
+	JWTKeySet       string
+	JWTKey          string
+	JWTIssuer       string
+	JWTAudience     string
+	JWTIdentity     string
+	JWTClaimLabels  []string
+
+	RateLimitKey       string
+	RateLimit          float64
+	RateLimitBurst     int
+	RateLimitOverrides []string
+
+	MaxBodyBytes        int64
+	MaxDecompressed     int64
+	MaxFamilies         int
+	MaxSeries           int
+	MaxLabels           int
+	MaxLabelValueLength int
+
+	PartialPushes       bool
+	TypeConflictPolicy  string
+	PutReplaces         bool
+	IdempotencyTTL      time.Duration
+	IdempotencyMaxKeys  int
+	LabelConflictPolicy string
+	QueryLabels         []string
+	HeaderLabels        []string
+	Enrich              []string
+	IngestQueueSize     int
+	IngestWorkers       int
+	MemorySoftLimit     int64
+	MemoryHardLimit     int64
+	GeoIPDatabase       string
+	TrustedProxies      []string
 }
 
 const (
@@ -1,13 +1,15 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,22 +17,30 @@ import (
 	"github.com/prometheus/common/expfmt"
 )
 
-type metricFamily struct {
-	*dto.MetricFamily
-	lock sync.RWMutex
-}
-
 type Aggregate struct {
-	familiesLock sync.RWMutex
-	families     map[string]*metricFamily
-	options      aggregateOptions
+	families    *familyShards
+	options     aggregateOptions
+	conflicts   *typeConflicts
+	idempotency *idempotencyCache
+	ingest      *ingestQueue
+	memory      *memoryBudget
+	// tracker keeps the shared label strings and the memory budget up to
+	// date as series are stored and removed
+	tracker *seriesTracker
 }
 
 type ignoredLabels []string
 
 type aggregateOptions struct {
-	ignoredLabels     ignoredLabels
-	metricTTLDuration *time.Duration
+	ignoredLabels       ignoredLabels
+	metricTTLDuration   *time.Duration
+	pushLimits          PushLimits
+	partialPushes       bool
+	typeConflictPolicy  TypeConflictPolicy
+	putReplaces         bool
+	labelConflictPolicy LabelConflictPolicy
+	requestLabels       requestLabels
+	enrichments         Enrichments
 }
 
 type aggregateOptionsFunc func(a *Aggregate)
@@ -47,12 +57,32 @@ func SetTTLMetricTime(duration *time.Duration) aggregateOptionsFunc {
 	}
 }
 
+// SetPartialPushes makes pushes apply every valid family and report the
+// rejected ones, instead of rejecting the whole push
+func SetPartialPushes(partial bool) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.partialPushes = partial
+	}
+}
+
+// SetPutReplaces makes PUT requests replace every series carrying the labels
+// in the path, like the pushgateway, instead of adding to them
+func SetPutReplaces(replace bool) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.putReplaces = replace
+	}
+}
+
 func NewAggregate(opts ...aggregateOptionsFunc) *Aggregate {
 	a := &Aggregate{
-		families: map[string]*metricFamily{},
+		families: newFamilyShards(defaultFamilyShards),
 		options: aggregateOptions{
-			ignoredLabels: []string{},
+			ignoredLabels:       []string{},
+			typeConflictPolicy:  TypeConflictReject,
+			labelConflictPolicy: LabelConflictReject,
 		},
+		conflicts: newTypeConflicts(),
+		memory:    &memoryBudget{},
 	}
 
 	for _, opt := range opts {
@@ -60,6 +90,11 @@ func NewAggregate(opts ...aggregateOptionsFunc) *Aggregate {
 	}
 
 	a.options.formatOptions()
+	a.tracker = &seriesTracker{interned: newInternTable(), memory: a.memory, now: time.Now}
+
+	if a.ingest != nil {
+		a.ingest.start(a)
+	}
 
 	return a
 }
@@ -79,103 +114,142 @@ func (ao *aggregateOptions) formatIgnoredLabels() {
 }
 
 func (a *Aggregate) Len() int {
-	a.familiesLock.RLock()
-	count := len(a.families)
-	a.familiesLock.RUnlock()
-	return count
-}
-
-// setFamilyOrGetExistingFamily either sets a new family or returns an existing family
-func (a *Aggregate) setFamilyOrGetExistingFamily(familyName string, family *dto.MetricFamily) *metricFamily {
-	a.familiesLock.Lock()
-	defer a.familiesLock.Unlock()
-	existingFamily, ok := a.families[familyName]
-	if !ok {
-		a.families[familyName] = &metricFamily{MetricFamily: family}
-		return nil
-	}
-	return existingFamily
+	return a.families.len()
 }
 
-func (a *Aggregate) saveFamily(familyName string, family *dto.MetricFamily) error {
-	existingFamily := a.setFamilyOrGetExistingFamily(familyName, family)
-	if existingFamily != nil {
-		err := existingFamily.mergeFamily(family)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+func parseFamilies(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(r)
 }
 
 func (a *Aggregate) parseAndMerge(r io.Reader, labels []labelPair) error {
-	var parser expfmt.TextParser
-	inFamilies, err := parser.TextToMetricFamilies(r)
+	inFamilies, err := parseFamilies(r)
 	if err != nil {
 		return err
 	}
 
-	for name, family := range inFamilies {
-		// Sort labels in case source sends them inconsistently
-		for _, m := range family.Metric {
-			if err := a.formatLabels(m, labels); err != nil {
-				return err
-			}
-		}
-
-		if err := validateFamily(family); err != nil {
-			return err
-		}
+	return a.mergeFamilies(inFamilies, labels)
+}
 
-		// family must be sorted for the merge
-		sort.Sort(byLabel(family.Metric))
+func (a *Aggregate) HandleRender(c *gin.Context) {
+	selectors, err := parseSelectors(c.QueryArray("match[]"))
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shard, err := parseScrapeShard(c)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		if err := a.saveFamily(name, family); err != nil {
-			return err
-		}
+	contentType := expfmt.Negotiate(c.Request.Header)
+	c.Header("Content-Type", string(contentType))
 
-		MetricCountByFamily.WithLabelValues(name).Set(float64(len(family.Metric)))
+	var (
+		filters       []familyFilter
+		seriesFilters []seriesFilter
+	)
+	if policy := pushPolicyFromContext(c); policy != nil {
+		filters = append(filters, policy.AllowFamily)
+	}
+	if selectors != nil {
+		filters = append(filters, selectors.matchesFamily)
+		seriesFilters = append(seriesFilters, selectors.seriesFilter)
+	}
+	if shard != nil {
+		filters = append(filters, shard.includesFamily)
+		seriesFilters = append(seriesFilters, shard.seriesFilter)
+	}
 
+	var writer io.Writer = c.Writer
+	if encoding := negotiateEncoding(c.GetHeader("Accept-Encoding")); encoding != "" {
+		compressed, err := compressWriter(encoding, c.Writer)
+		if err != nil {
+			log.Printf("unable to compress metrics with %s: %v", encoding, err)
+		} else {
+			c.Header("Content-Encoding", encoding)
+			c.Header("Vary", "Accept-Encoding")
+			defer compressed.Close()
+			writer = compressed
+		}
 	}
 
-	TotalFamiliesGauge.Set(float64(a.Len()))
+	a.encodeMetrics(writer, contentType, seriesFilters, filters...)
 
-	return nil
+	// TODO reset gauges
 }
 
-func (a *Aggregate) HandleRender(c *gin.Context) {
-	contentType := expfmt.Negotiate(c.Request.Header)
-	c.Header("Content-Type", string(contentType))
-	a.encodeAllMetrics(c.Writer, contentType)
+// familyFilter decides whether a family is included when rendering
+type familyFilter func(name string) bool
 
-	// TODO reset gauges
+func includeFamily(name string, filters []familyFilter) bool {
+	for _, filter := range filters {
+		if !filter(name) {
+			return false
+		}
+	}
+	return true
 }
 
-func (a *Aggregate) encodeAllMetrics(writer io.Writer, contentType expfmt.Format) {
-	enc := expfmt.NewEncoder(writer, contentType)
+// seriesFilter decides which series of a family are included when
+// rendering, returning nil when all of them are
+type seriesFilter func(family string) func(m *dto.Metric) bool
+
+// includedSeries combines the series filters for a family, returning nil
+// when every series is included
+func includedSeries(family string, filters []seriesFilter) func(m *dto.Metric) bool {
+	var includes []func(m *dto.Metric) bool
+	for _, filter := range filters {
+		if include := filter(family); include != nil {
+			includes = append(includes, include)
+		}
+	}
+	if len(includes) == 0 {
+		return nil
+	}
+	return func(m *dto.Metric) bool {
+		for _, include := range includes {
+			if !include(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
 
-	a.familiesLock.RLock()
-	defer a.familiesLock.RUnlock()
+func (a *Aggregate) encodeAllMetrics(writer io.Writer, contentType expfmt.Format, filters ...familyFilter) {
+	a.encodeMetrics(writer, contentType, nil, filters...)
+}
 
-	metricNames := []string{}
+func (a *Aggregate) encodeMetrics(writer io.Writer, contentType expfmt.Format, seriesFilters []seriesFilter, filters ...familyFilter) {
+	// only the family being encoded is locked, so pushes to the others
+	// aren't held up by a long scrape, and families that haven't changed
+	// since they were last encoded aren't encoded again
 	metricTypeCounts := make(map[string]int)
-	for name, family := range a.families {
-		metricNames = append(metricNames, name)
+	for _, f := range a.families.snapshot() {
 		var typeName string
-		if family.Type == nil {
+		if f.family.Type == nil {
 			typeName = "unknown"
 		} else {
-			typeName = dto.MetricType_name[int32(*family.Type)]
+			typeName = dto.MetricType_name[int32(*f.family.Type)]
 		}
 		metricTypeCounts[typeName]++
-	}
 
-	sort.Strings(metricNames)
-
-	for _, name := range metricNames {
-		if a.encodeMetric(name, enc) {
-			return
+		if !includeFamily(f.name, filters) {
+			continue
+		}
+		var err error
+		if include := includedSeries(f.name, seriesFilters); include != nil {
+			err = f.family.encodeSeriesTo(writer, contentType, include)
+		} else {
+			err = f.family.encodeTo(writer, contentType)
+		}
+		if err != nil {
+			// one family failing to encode mustn't cut the rest of the
+			// scrape short
+			log.Printf("An error has occurred during metrics encoding of %s:\n\n%s\n", f.name, err.Error())
+			continue
 		}
 	}
 
@@ -186,41 +260,195 @@ func (a *Aggregate) encodeAllMetrics(writer io.Writer, contentType expfmt.Format
 
 }
 
-func (a *Aggregate) encodeMetric(name string, enc expfmt.Encoder) bool {
-	a.families[name].lock.RLock()
-	defer a.families[name].lock.RUnlock()
-
-	if err := enc.Encode(a.families[name].MetricFamily); err != nil {
-		log.Printf("An error has occurred during metrics encoding:\n\n%s\n", err.Error())
-		return true
-	}
-	return false
-}
-
-var ErrOddNumberOfLabelParts = errors.New("labels must be defined in pairs")
+var (
+	ErrOddNumberOfLabelParts = errors.New("labels must be defined in pairs")
+	ErrNoLabelsToReplace     = errors.New("labels to replace series by are required")
+	ErrInvalidBase64Label    = errors.New("invalid base64 label value")
+)
 
 func (a *Aggregate) HandleInsert(c *gin.Context) {
 	labelParts, jobName, err := parseLabelsInPath(c)
 	if err != nil {
 		log.Println(err)
-		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		writePushErrors(c, http.StatusBadRequest, newPushError("", err))
+		return
+	}
+
+	// a replace removes the series carrying the labels in the path, so it
+	// needs some there, whatever labels the request adds to the series
+	replace := a.options.putReplaces && c.Request.Method == http.MethodPut
+	if replace && len(labelParts) == 0 {
+		writePushErrors(c, http.StatusBadRequest, newPushError("", ErrNoLabelsToReplace))
+		return
+	}
+
+	labelParts = a.options.requestLabels.withRequestLabels(c, labelParts)
+	a.options.enrichments.apply(c)
+	labelParts = withContextLabels(c, labelParts)
+	for _, l := range labelParts {
+		if l.name == "job" {
+			jobName = l.value
+		}
+	}
+
+	policy := pushPolicyFromContext(c)
+	if policy != nil && !policy.AllowJob(jobName) {
+		err := categorize(categoryForbidden, fmt.Errorf("push to job %q is not allowed", jobName))
+		writePushErrors(c, http.StatusForbidden, newPushError("", err))
+		return
+	}
+
+	body, err := a.readBody(c)
+	if err != nil {
+		status, err := bodyError(err)
+		writePushErrors(c, status, newPushError("", err))
 		return
 	}
 
-	if err := a.parseAndMerge(c.Request.Body, labelParts); err != nil {
+	handled, finish := a.handleIdempotencyKey(c, body)
+	if handled {
+		return
+	}
+	defer finish()
+
+	inFamilies, err := parseFamilies(bytes.NewReader(body))
+	if err != nil {
+		status, err := bodyError(err)
 		log.Println(err)
-		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		writePushErrors(c, status, newPushError("", err))
+		return
+	}
+
+	if err := a.options.pushLimits.check(inFamilies, labelParts); err != nil {
+		writePushErrors(c, http.StatusBadRequest, newPushError("", err))
+		return
+	}
+
+	if policy != nil {
+		if name := checkFamiliesAllowed(policy, inFamilies); name != "" {
+			err := categorize(categoryForbidden, fmt.Errorf("push of metric %q is not allowed", name))
+			writePushErrors(c, http.StatusForbidden, newPushError(name, err))
+			return
+		}
+	}
+
+	if a.options.labelConflictPolicy == LabelConflictBodyWins {
+		dropContextLabels(c, inFamilies)
+	}
+
+	if policy != nil {
+		// labels on series may set the job too, so the job each series is
+		// stored under is checked as well as the one in the path
+		if name, job := a.checkJobsAllowed(policy, inFamilies, labelParts); name != "" {
+			err := categorize(categoryForbidden, fmt.Errorf("push to job %q is not allowed", job))
+			writePushErrors(c, http.StatusForbidden, newPushError(name, err))
+			return
+		}
+	}
+
+	partial := a.options.partialPushes
+	if value, ok := c.GetQuery("partial"); ok {
+		partial = value == "true" || value == "1"
+	}
+
+	var result pushResult
+	if a.ingest != nil && !replace {
+		// queued pushes are validated now, so clients still hear about
+		// invalid ones, and merged later by the ingest workers
+		result, err = a.enqueuePush(inFamilies, labelParts, partial)
+		if err != nil {
+			c.Header("Retry-After", "1")
+			writePushErrors(c, http.StatusServiceUnavailable, newPushError("", err))
+			return
+		}
+	} else {
+		// like deletes, a replace only removes series from the families the
+		// request may push
+		var filters []familyFilter
+		if policy != nil {
+			filters = append(filters, policy.AllowFamily)
+		}
+		result = a.pushFamilies(inFamilies, labelParts, partial, replace, filters...)
+	}
+	addFamilyLines(body, result.Rejected)
+	if !partial && len(result.Rejected) > 0 {
+		log.Println(result.Rejected[0].err)
+		writePushErrors(c, rejectedStatus(result.Rejected), result.Rejected...)
+		return
+	}
+
+	if len(result.Accepted) > 0 {
+		MetricPushes.WithLabelValues(jobName).Inc()
+	}
+
+	if partial {
+		status := http.StatusAccepted
+		if len(result.Accepted) == 0 && len(result.Rejected) > 0 {
+			status = rejectedStatus(result.Rejected)
+		}
+		c.JSON(status, result)
 		return
 	}
 
-	MetricPushes.WithLabelValues(jobName).Inc()
 	c.Status(http.StatusAccepted)
 }
 
+// rejectedStatus picks the status code for a rejected push. Families only
+// turned away by the memory budget aren't the client's fault, so they get
+// their own status.
+func rejectedStatus(rejected []pushError) int {
+	for _, e := range rejected {
+		if !errors.Is(e.err, ErrMemoryBudgetExceeded) {
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusInsufficientStorage
+}
+
+// readBody reads the whole push body, decompressing it and enforcing the
+// size limits. The body is kept so errors can point at lines within it.
+func (a *Aggregate) readBody(c *gin.Context) ([]byte, error) {
+	var body io.Reader = c.Request.Body
+	if maxBytes := a.options.pushLimits.MaxBodyBytes; maxBytes > 0 {
+		body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+	}
+
+	body, closeBody, err := decompressBody(c.GetHeader("Content-Encoding"), body, a.options.pushLimits.MaxDecompressedBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody()
+
+	return io.ReadAll(body)
+}
+
+// bodyError picks the status code for an error reading a push body
+func bodyError(err error) (int, error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, limitError("request body is larger than %d bytes", maxBytesErr.Limit)
+	case errors.Is(err, ErrPushLimitExceeded):
+		return http.StatusRequestEntityTooLarge, err
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType, err
+	}
+	return http.StatusBadRequest, err
+}
+
+// JobName returns the job label from the path of a push request, or an empty
+// string if there is none
+func JobName(c *gin.Context) string {
+	_, jobName, _ := parseLabelsInPath(c)
+	return jobName
+}
+
 type labelPair struct {
 	name, value string
 }
 
+const base64LabelSuffix = "@base64"
+
 func parseLabelsInPath(c *gin.Context) ([]labelPair, string, error) {
 	labelString := c.Param("labels")
 	labelString = strings.Trim(labelString, "/")
@@ -240,6 +468,15 @@ func parseLabelsInPath(c *gin.Context) ([]labelPair, string, error) {
 	for idx := 0; idx < len(labelParts); idx += 2 {
 		name := labelParts[idx]
 		value := labelParts[idx+1]
+		// like the pushgateway, label@base64/<value> carries values that
+		// contain slashes or are empty, with "=" encoding an empty value
+		if base, encoded := strings.CutSuffix(name, base64LabelSuffix); encoded {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, "", fmt.Errorf("%w for label %s: %v", ErrInvalidBase64Label, base, err)
+			}
+			name, value = base, string(decoded)
+		}
 		labelPairs = append(labelPairs, labelPair{name, value})
 		if name == "job" {
 			jobName = value
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/gin-gonic/gin"
 	"github.com/pmezard/go-difflib/difflib"
 	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/require"
@@ -252,6 +254,40 @@ func BenchmarkAggregate(b *testing.B) {
 	}
 }
 
+func TestParseLabelsInPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		labels  []labelPair
+		jobName string
+		err     string
+	}{
+		{"plain", "/job/a/instance/b", []labelPair{{"job", "a"}, {"instance", "b"}}, "a", ""},
+		{"base64", "/job@base64/L3RtcC94", []labelPair{{"job", "/tmp/x"}}, "/tmp/x", ""},
+		{"base64 with padding", "/path@base64/YS9i", []labelPair{{"path", "a/b"}}, "", ""},
+		{"base64 url alphabet", "/v@base64/-_8", []labelPair{{"v", "\xfb\xff"}}, "", ""},
+		{"empty value", "/job/a/instance@base64/=", []labelPair{{"job", "a"}, {"instance", ""}}, "a", ""},
+		{"invalid base64", "/job@base64/!!", nil, "", "invalid base64 label value for label job: illegal base64 data at input byte 0"},
+		{"odd parts", "/job", nil, "", "labels must be defined in pairs"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Params = gin.Params{{Key: "labels", Value: test.path}}
+
+			labels, jobName, err := parseLabelsInPath(c)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.labels, labels)
+			require.Equal(t, test.jobName, jobName)
+		})
+	}
+}
+
 func BenchmarkConcurrentAggregate(b *testing.B) {
 	a := NewAggregate()
 	for _, v := range testMetricTable {
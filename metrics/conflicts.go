@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TypeConflictPolicy decides what happens when a family is pushed with a
+// different type than the one stored
+type TypeConflictPolicy string
+
+const (
+	// TypeConflictReject rejects the conflicting family
+	TypeConflictReject TypeConflictPolicy = "reject"
+	// TypeConflictReplace replaces the stored family with the pushed one
+	TypeConflictReplace TypeConflictPolicy = "replace"
+	// TypeConflictKeepBoth stores the pushed family under its name suffixed
+	// with its type, e.g. queue_depth_counter
+	TypeConflictKeepBoth TypeConflictPolicy = "keep_both"
+	// TypeConflictCoerceUntyped merges untyped families into stored
+	// counters and gauges, and rejects any other conflict
+	TypeConflictCoerceUntyped TypeConflictPolicy = "coerce_untyped"
+)
+
+var typeConflictPolicies = []TypeConflictPolicy{
+	TypeConflictReject,
+	TypeConflictReplace,
+	TypeConflictKeepBoth,
+	TypeConflictCoerceUntyped,
+}
+
+// ParseTypeConflictPolicy parses a policy name, defaulting to reject when
+// it is empty
+func ParseTypeConflictPolicy(value string) (TypeConflictPolicy, error) {
+	if value == "" {
+		return TypeConflictReject, nil
+	}
+	for _, policy := range typeConflictPolicies {
+		if string(policy) == value {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown type conflict policy %q", value)
+}
+
+func SetTypeConflictPolicy(policy TypeConflictPolicy) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.typeConflictPolicy = policy
+	}
+}
+
+// TypeConflict records pushes of a family with a different type than the
+// one stored, and how they were resolved
+type TypeConflict struct {
+	Family     string    `json:"family"`
+	StoredType string    `json:"storedType"`
+	PushedType string    `json:"pushedType"`
+	Resolution string    `json:"resolution"`
+	StoredAs   string    `json:"storedAs,omitempty"`
+	Count      int       `json:"count"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+// typeConflicts keeps the conflicts seen since startup, one per family and
+// pushed type
+type typeConflicts struct {
+	lock      sync.Mutex
+	conflicts map[string]*TypeConflict
+	now       func() time.Time
+}
+
+func newTypeConflicts() *typeConflicts {
+	return &typeConflicts{
+		conflicts: map[string]*TypeConflict{},
+		now:       time.Now,
+	}
+}
+
+// resolvedConflict is how the type conflict of one pushed family was
+// resolved. It is only recorded once the push is merged or rejected, so a
+// resolution that was never applied isn't reported.
+type resolvedConflict struct {
+	family         string
+	stored, pushed dto.MetricType
+	resolution     TypeConflictPolicy
+	storedAs       string
+}
+
+func (tc *typeConflicts) record(resolved ...resolvedConflict) {
+	if len(resolved) == 0 {
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	now := tc.now()
+	for _, r := range resolved {
+		TypeConflictsTotal.WithLabelValues(string(r.resolution)).Inc()
+
+		key := r.family + "/" + r.pushed.String()
+		conflict, ok := tc.conflicts[key]
+		if !ok {
+			conflict = &TypeConflict{
+				Family:     r.family,
+				PushedType: r.pushed.String(),
+				FirstSeen:  now,
+			}
+			tc.conflicts[key] = conflict
+		}
+		conflict.StoredType = r.stored.String()
+		conflict.Resolution = string(r.resolution)
+		conflict.StoredAs = r.storedAs
+		conflict.Count++
+		conflict.LastSeen = now
+	}
+}
+
+func (tc *typeConflicts) list(filters []familyFilter) []TypeConflict {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	list := make([]TypeConflict, 0, len(tc.conflicts))
+	for _, conflict := range tc.conflicts {
+		if includeFamily(conflict.Family, filters) {
+			list = append(list, *conflict)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Family != list[j].Family {
+			return list[i].Family < list[j].Family
+		}
+		return list[i].PushedType < list[j].PushedType
+	})
+	return list
+}
+
+// TypeConflicts returns the type conflicts seen since startup
+func (a *Aggregate) TypeConflicts() []TypeConflict {
+	return a.conflicts.list(nil)
+}
+
+// HandleTypeConflicts lists the type conflicts seen since startup
+func (a *Aggregate) HandleTypeConflicts(c *gin.Context) {
+	var filters []familyFilter
+	if policy := pushPolicyFromContext(c); policy != nil {
+		filters = append(filters, policy.AllowFamily)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policy":    a.options.typeConflictPolicy,
+		"conflicts": a.conflicts.list(filters),
+	})
+}
+
+// typeConflictResolution returns how the type conflict policy resolves a
+// family whose type differs from the stored one, without applying it. The
+// shards of the family and of its keepBothName must be locked.
+func (a *Aggregate) typeConflictResolution(stored *metricFamily, family *dto.MetricFamily) TypeConflictPolicy {
+	switch a.options.typeConflictPolicy {
+	case TypeConflictReplace:
+		return TypeConflictReplace
+
+	case TypeConflictKeepBoth:
+		if existing, ok := a.families.lookup(keepBothName(family)); ok && existing.GetType() != family.GetType() {
+			break
+		}
+		return TypeConflictKeepBoth
+
+	case TypeConflictCoerceUntyped:
+		if canCoerceUntyped(family, stored.GetType()) {
+			return TypeConflictCoerceUntyped
+		}
+	}
+	return TypeConflictReject
+}
+
+// resolveTypeConflict applies the type conflict policy to a family whose type
+// differs from the stored one. It returns the name to store the family under,
+// whether it replaces the stored family, and the resolution to record. The
+// shards of the family and of its keepBothName must be locked.
+func (a *Aggregate) resolveTypeConflict(stored *metricFamily, family *dto.MetricFamily, conflict error) (string, bool, resolvedConflict, error) {
+	name := family.GetName()
+	resolved := resolvedConflict{
+		family:     name,
+		stored:     stored.GetType(),
+		pushed:     family.GetType(),
+		resolution: a.typeConflictResolution(stored, family),
+	}
+
+	switch resolved.resolution {
+	case TypeConflictReplace:
+		return name, true, resolved, nil
+
+	case TypeConflictKeepBoth:
+		resolved.storedAs = keepBothName(family)
+		family.Name = &resolved.storedAs
+		return resolved.storedAs, false, resolved, nil
+
+	case TypeConflictCoerceUntyped:
+		coerceUntyped(family, resolved.stored)
+		return name, false, resolved, nil
+	}
+
+	return "", false, resolved, conflict
+}
+
+// keepBothName is the name a family is stored under when the keep_both
+// policy resolves a type conflict
+func keepBothName(family *dto.MetricFamily) string {
+	return family.GetName() + "_" + strings.ToLower(family.GetType().String())
+}
+
+// canCoerceUntyped reports whether an untyped family can be converted to
+// the type to. Other types can't be built from untyped samples.
+func canCoerceUntyped(family *dto.MetricFamily, to dto.MetricType) bool {
+	return family.GetType() == dto.MetricType_UNTYPED &&
+		(to == dto.MetricType_COUNTER || to == dto.MetricType_GAUGE)
+}
+
+// coerceUntyped converts an untyped family to a counter or gauge, returning
+// false if it can't be. The series are replaced rather than changed, as they
+// may be shared with the push they came from.
+func coerceUntyped(family *dto.MetricFamily, to dto.MetricType) bool {
+	if !canCoerceUntyped(family, to) {
+		return false
+	}
+
+	for i, m := range family.Metric {
+		coerced := &dto.Metric{Label: m.Label, TimestampMs: m.TimestampMs}
+		value := m.GetUntyped().GetValue()
+		if to == dto.MetricType_COUNTER {
+			coerced.Counter = &dto.Counter{Value: float64ptr(value)}
+		} else {
+			coerced.Gauge = &dto.Gauge{Value: float64ptr(value)}
+		}
+		family.Metric[i] = coerced
+	}
+	family.Type = to.Enum()
+	return true
+}
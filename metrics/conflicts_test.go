@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTypeConflictPolicy(t *testing.T) {
+	policy, err := ParseTypeConflictPolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, TypeConflictReject, policy)
+
+	policy, err = ParseTypeConflictPolicy("keep_both")
+	require.NoError(t, err)
+	assert.Equal(t, TypeConflictKeepBoth, policy)
+
+	_, err = ParseTypeConflictPolicy("merge")
+	assert.EqualError(t, err, `unknown type conflict policy "merge"`)
+}
+
+func TestTypeConflictPolicies(t *testing.T) {
+	const stored = "# TYPE a counter\na 1\n# TYPE h histogram\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n"
+
+	tests := []struct {
+		name     string
+		policy   TypeConflictPolicy
+		push     string
+		err      string
+		expected string
+	}{
+		{
+			"reject",
+			TypeConflictReject,
+			"# TYPE a gauge\na 2\n",
+			"cannot merge metric 'a': type COUNTER != GAUGE",
+			"# TYPE a counter\na 1\n",
+		},
+		{
+			"replace",
+			TypeConflictReplace,
+			"# TYPE a gauge\na 2\n",
+			"",
+			"# TYPE a gauge\na 2\n",
+		},
+		{
+			"keep both",
+			TypeConflictKeepBoth,
+			"# TYPE a gauge\na 2\n",
+			"",
+			"# TYPE a counter\na 1\n# TYPE a_gauge gauge\na_gauge 2\n",
+		},
+		{
+			"coerce untyped",
+			TypeConflictCoerceUntyped,
+			"a 2\n",
+			"",
+			"# TYPE a counter\na 3\n",
+		},
+		{
+			"coerce typed",
+			TypeConflictCoerceUntyped,
+			"# TYPE a gauge\na 2\n",
+			"cannot merge metric 'a': type COUNTER != GAUGE",
+			"# TYPE a counter\na 1\n",
+		},
+		{
+			"coerce untyped to histogram",
+			TypeConflictCoerceUntyped,
+			"h 2\n",
+			"cannot merge metric 'h': type HISTOGRAM != UNTYPED",
+			"# TYPE a counter\na 1\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agg := NewAggregate(SetTypeConflictPolicy(test.policy))
+			require.NoError(t, agg.parseAndMerge(strings.NewReader(stored), nil))
+
+			err := agg.parseAndMerge(strings.NewReader(test.push), nil)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			rendered := renderText(agg)
+			assert.True(t, strings.HasPrefix(rendered, test.expected), rendered)
+
+			conflicts := agg.TypeConflicts()
+			require.Len(t, conflicts, 1)
+			assert.Equal(t, 1, conflicts[0].Count)
+			if test.err != "" {
+				assert.Equal(t, string(TypeConflictReject), conflicts[0].Resolution)
+			} else {
+				assert.Equal(t, string(test.policy), conflicts[0].Resolution)
+			}
+		})
+	}
+}
+
+func TestTypeConflictsRecord(t *testing.T) {
+	agg := NewAggregate(SetTypeConflictPolicy(TypeConflictKeepBoth))
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	agg.conflicts.now = func() time.Time { return now }
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE a counter\na 1\n"), nil))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE a gauge\na 2\n"), nil))
+	now = now.Add(time.Minute)
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE a gauge\na 3\n"), nil))
+
+	assert.Equal(t, []TypeConflict{{
+		Family:     "a",
+		StoredType: "COUNTER",
+		PushedType: "GAUGE",
+		Resolution: "keep_both",
+		StoredAs:   "a_gauge",
+		Count:      2,
+		FirstSeen:  now.Add(-time.Minute),
+		LastSeen:   now,
+	}}, agg.TypeConflicts())
+	assert.Equal(t, "# TYPE a counter\na 1\n# TYPE a_gauge gauge\na_gauge 5\n", renderText(agg))
+}
+
+func TestTypeConflictsOfRejectedPush(t *testing.T) {
+	agg := NewAggregate(SetTypeConflictPolicy(TypeConflictCoerceUntyped))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE a counter\na 1\n# TYPE b counter\nb 1\n"), nil))
+
+	// a could be coerced, but the push is rejected for b, so only the
+	// rejection is recorded
+	err := agg.parseAndMerge(strings.NewReader("a 2\n# TYPE b gauge\nb 2\n"), nil)
+	assert.EqualError(t, err, "cannot merge metric 'b': type COUNTER != GAUGE")
+
+	conflicts := agg.TypeConflicts()
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, "b", conflicts[0].Family)
+	assert.Equal(t, string(TypeConflictReject), conflicts[0].Resolution)
+	assert.Equal(t, "# TYPE a counter\na 1\n# TYPE b counter\nb 1\n", renderText(agg))
+}
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var ErrNoLabelsToDelete = errors.New("labels to delete series by are required")
+
+// deleteResult reports how much was removed by a delete
+type deleteResult struct {
+	Families int `json:"families"`
+	Series   int `json:"series"`
+}
+
+// HandleDelete removes every series carrying the labels in the path, like
+// deleting a group from the pushgateway. /metrics/family/<name> removes a
+// whole family instead.
+func (a *Aggregate) HandleDelete(c *gin.Context) {
+	if name, ok := strings.CutPrefix(strings.Trim(c.Param("labels"), "/"), "family/"); ok && !strings.Contains(name, "/") {
+		a.handleDeleteFamily(c, name)
+		return
+	}
+
+	labels, jobName, err := parseLabelsInPath(c)
+	if err == nil && len(labels) == 0 {
+		err = ErrNoLabelsToDelete
+	}
+	if err != nil {
+		writePushErrors(c, http.StatusBadRequest, newPushError("", err))
+		return
+	}
+
+	var filters []familyFilter
+	if policy := pushPolicyFromContext(c); policy != nil {
+		if !policy.AllowJob(jobName) {
+			err := categorize(categoryForbidden, fmt.Errorf("delete from job %q is not allowed", jobName))
+			writePushErrors(c, http.StatusForbidden, newPushError("", err))
+			return
+		}
+		filters = append(filters, policy.AllowFamily)
+	}
+
+	c.JSON(http.StatusAccepted, a.deleteSeries(labels, filters...))
+}
+
+func (a *Aggregate) handleDeleteFamily(c *gin.Context, name string) {
+	var allowJob func(job string) bool
+	if policy := pushPolicyFromContext(c); policy != nil {
+		if !policy.AllowFamily(name) {
+			err := categorize(categoryForbidden, fmt.Errorf("delete of metric %q is not allowed", name))
+			writePushErrors(c, http.StatusForbidden, newPushError(name, err))
+			return
+		}
+		// a family may hold series of jobs the request may not delete from,
+		// so only the series of the jobs it may are removed
+		allowJob = policy.AllowJob
+	}
+
+	result, found := a.deleteFamily(name, allowJob)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("metric %q not found", name)})
+		return
+	}
+	c.JSON(http.StatusAccepted, result)
+}
+
+// deleteSeries removes the series carrying all of the labels from every
+// family the filters include
+func (a *Aggregate) deleteSeries(labels []labelPair, filters ...familyFilter) deleteResult {
+	var result deleteResult
+
+	matchers := a.seriesMatchers(labels)
+	if len(matchers) == 0 {
+		return result
+	}
+
+	// shards are deleted from one at a time, so pushes to the others carry on
+	for i := range a.families.shards {
+		set := shardSet{i}
+		a.families.lock(set)
+		a.families.rangeLocked(set, func(name string, family *metricFamily) {
+			if !includeFamily(name, filters) {
+				return
+			}
+
+			family.lock.Lock()
+			removed := family.removeSeries(matchers)
+			kept := family.len()
+			family.lock.Unlock()
+
+			if removed == 0 {
+				return
+			}
+			result.Series += removed
+			if kept == 0 {
+				a.families.remove(name)
+				MetricCountByFamily.DeleteLabelValues(name)
+				result.Families++
+			} else {
+				MetricCountByFamily.WithLabelValues(name).Set(float64(kept))
+			}
+		})
+		a.families.unlock(set)
+	}
+
+	TotalFamiliesGauge.Set(float64(a.families.len()))
+	return result
+}
+
+// seriesMatchers drops ignored labels from labels to match series by, as
+// they were dropped from series when pushed and so match every series
+func (a *Aggregate) seriesMatchers(labels []labelPair) []labelPair {
+	matchers := make([]labelPair, 0, len(labels))
+	for _, l := range labels {
+		if !a.options.ignoredLabels.labelInIgnoredList(&dto.LabelPair{Name: strPtr(l.name)}) {
+			matchers = append(matchers, l)
+		}
+	}
+	return matchers
+}
+
+// deleteFamily removes a whole family, reporting whether it existed. With
+// allowJob set, only the series of the jobs it allows are removed, and the
+// family is only removed once none are left.
+func (a *Aggregate) deleteFamily(name string, allowJob func(job string) bool) (deleteResult, bool) {
+	set := a.families.shardsOf(name)
+	a.families.lock(set)
+	defer a.families.unlock(set)
+
+	family, ok := a.families.lookup(name)
+	if !ok {
+		return deleteResult{}, false
+	}
+
+	var (
+		result deleteResult
+		kept   int
+	)
+	family.lock.Lock()
+	if allowJob == nil {
+		result.Series = family.len()
+	} else {
+		result.Series = family.removeSeriesWhere(func(m *dto.Metric) bool {
+			return allowJob(labelValue(m, "job"))
+		})
+		kept = family.len()
+	}
+	family.lock.Unlock()
+
+	if kept > 0 {
+		MetricCountByFamily.WithLabelValues(name).Set(float64(kept))
+		return result, true
+	}
+
+	a.families.remove(name)
+	MetricCountByFamily.DeleteLabelValues(name)
+	TotalFamiliesGauge.Set(float64(a.families.len()))
+	result.Families = 1
+	return result, true
+}
+
+// seriesHasLabels reports whether a series carries all of the labels. A
+// label with an empty value matches series without that label.
+func seriesHasLabels(m *dto.Metric, labels []labelPair) bool {
+	for _, l := range labels {
+		value := ""
+		for _, have := range m.Label {
+			if have.GetName() == l.name {
+				value = have.GetValue()
+				break
+			}
+		}
+		if value != l.value {
+			return false
+		}
+	}
+	return true
+}
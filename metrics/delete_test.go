@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteSeries(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []labelPair
+		filters  []familyFilter
+		result   deleteResult
+		expected string
+	}{
+		{
+			"by job",
+			[]labelPair{{"job", "a"}},
+			nil,
+			deleteResult{Families: 1, Series: 3},
+			"# TYPE bar gauge\nbar{job=\"b\"} 4\n",
+		},
+		{
+			"by job and instance",
+			[]labelPair{{"job", "a"}, {"instance", "1"}},
+			nil,
+			deleteResult{Families: 0, Series: 1},
+			"# TYPE bar gauge\nbar{instance=\"2\",job=\"a\"} 3\nbar{job=\"b\"} 4\n# TYPE foo counter\nfoo{instance=\"2\",job=\"a\"} 2\n",
+		},
+		{
+			"empty value matches missing label",
+			[]labelPair{{"instance", ""}},
+			nil,
+			deleteResult{Families: 0, Series: 1},
+			"# TYPE bar gauge\nbar{instance=\"2\",job=\"a\"} 3\n# TYPE foo counter\nfoo{instance=\"1\",job=\"a\"} 1\nfoo{instance=\"2\",job=\"a\"} 2\n",
+		},
+		{
+			"filtered families",
+			[]labelPair{{"job", "a"}},
+			[]familyFilter{func(name string) bool { return name == "bar" }},
+			deleteResult{Families: 0, Series: 1},
+			"# TYPE bar gauge\nbar{job=\"b\"} 4\n# TYPE foo counter\nfoo{instance=\"1\",job=\"a\"} 1\nfoo{instance=\"2\",job=\"a\"} 2\n",
+		},
+		{
+			"ignored label only",
+			[]labelPair{{"ignored", "x"}},
+			nil,
+			deleteResult{},
+			"# TYPE bar gauge\nbar{instance=\"2\",job=\"a\"} 3\nbar{job=\"b\"} 4\n# TYPE foo counter\nfoo{instance=\"1\",job=\"a\"} 1\nfoo{instance=\"2\",job=\"a\"} 2\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agg := NewAggregate(AddIgnoredLabels("ignored"))
+			require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE foo counter
+foo{job="a",instance="1"} 1
+foo{job="a",instance="2"} 2
+# TYPE bar gauge
+bar{job="a",instance="2"} 3
+bar{job="b"} 4
+`), nil))
+
+			assert.Equal(t, test.result, agg.deleteSeries(test.labels, test.filters...))
+			assert.Equal(t, test.expected, renderText(agg))
+		})
+	}
+}
+
+func TestDeleteFamily(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE foo counter\nfoo{x=\"1\"} 1\nfoo{x=\"2\"} 1\n# TYPE bar counter\nbar 1\n"), nil))
+
+	result, found := agg.deleteFamily("foo", nil)
+	assert.True(t, found)
+	assert.Equal(t, deleteResult{Families: 1, Series: 2}, result)
+
+	_, found = agg.deleteFamily("foo", nil)
+	assert.False(t, found)
+
+	assert.Equal(t, "# TYPE bar counter\nbar 1\n", renderText(agg))
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultMaxDecompressedBytes bounds decompressed push bodies when no
+// MaxDecompressedBytes limit is configured, so a small compressed body
+// can't expand to fill all memory
+const defaultMaxDecompressedBytes = 64 << 20
+
+// snappyStreamMagic starts every framed snappy stream
+const snappyStreamMagic = "\xff\x06\x00\x00sNaPpY"
+
+// ErrUnsupportedEncoding is returned for a Content-Encoding that pushes
+// can't be decompressed from
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// limitedBodyReader fails once more than max bytes have been read, rather
+// than silently truncating like io.LimitReader
+type limitedBodyReader struct {
+	r         io.Reader
+	remaining int64
+	max       int64
+}
+
+func (l *limitedBodyReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, l.err()
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), l.err()
+	}
+	return n, err
+}
+
+func (l *limitedBodyReader) err() error {
+	return limitError("decompressed body is larger than %d bytes", l.max)
+}
+
+// decompressBody wraps body to decode the given Content-Encoding. The
+// returned closer must be called once the body has been read.
+func decompressBody(encoding string, body io.Reader, maxBytes int64) (io.Reader, func(), error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxDecompressedBytes
+	}
+	noop := func() {}
+
+	var (
+		r      io.Reader
+		closer = noop
+	)
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, noop, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		r = gz
+	case "deflate":
+		var err error
+		if r, err = deflateReader(body); err != nil {
+			return nil, nil, err
+		}
+	case "zstd":
+		dec, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(maxBytes)),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		r, closer = &zstdBodyReader{dec, maxBytes}, dec.Close
+	case "snappy":
+		var err error
+		if r, err = snappyReader(body, maxBytes); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, encoding)
+	}
+
+	return &limitedBodyReader{r: r, remaining: maxBytes, max: maxBytes}, closer, nil
+}
+
+// zstdBodyReader reports frames that need more memory than allowed as
+// exceeding the push limit
+type zstdBodyReader struct {
+	*zstd.Decoder
+	max int64
+}
+
+func (z *zstdBodyReader) Read(p []byte) (int, error) {
+	n, err := z.Decoder.Read(p)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		err = limitError("decompressed body is larger than %d bytes", z.max)
+	}
+	return n, err
+}
+
+// deflateReader decodes the zlib-wrapped stream HTTP calls deflate, falling
+// back to a raw deflate stream, as some clients send that instead
+func deflateReader(body io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	header, err := buffered.Peek(2)
+	if err == nil && isZlibHeader(header) {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// isZlibHeader reports whether a stream starts with a zlib header using the
+// deflate method, whose two bytes are a multiple of 31 (RFC 1950)
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// snappyReader accepts both the framed snappy stream format and a single
+// snappy block, as sent by Prometheus remote write clients
+func snappyReader(body io.Reader, maxBytes int64) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	if magic, err := buffered.Peek(len(snappyStreamMagic)); err == nil && string(magic) == snappyStreamMagic {
+		return s2.NewReader(buffered), nil
+	}
+
+	// blocks can't be streamed, but they do declare their decoded length,
+	// so bombs are rejected before anything is allocated for them. The
+	// compressed block is bounded too, by the largest encoding of a block
+	// within the limit.
+	maxEncoded := int64(s2.MaxEncodedLen(int(maxBytes)))
+	if maxEncoded < 0 {
+		maxEncoded = maxBytes
+	}
+	compressed, err := io.ReadAll(io.LimitReader(buffered, maxEncoded+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(compressed)) > maxEncoded {
+		return nil, limitError("compressed snappy block is larger than %d bytes", maxEncoded)
+	}
+	decodedLen, err := s2.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if int64(decodedLen) > maxBytes {
+		return nil, limitError("decompressed body is larger than %d bytes", maxBytes)
+	}
+	decoded, err := s2.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(decoded), nil
+}
+
+// responseEncodings are the encodings scrapes can be compressed with, in
+// order of preference when a client accepts several equally
+var responseEncodings = []string{"zstd", "gzip"}
+
+// negotiateEncoding picks a response encoding from an Accept-Encoding
+// header, returning an empty string for an uncompressed response
+func negotiateEncoding(acceptEncoding string) string {
+	type candidate struct {
+		encoding string
+		q        float64
+		order    int
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+
+		for order, encoding := range responseEncodings {
+			if name == encoding {
+				candidates = append(candidates, candidate{encoding, q, order})
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].order < candidates[j].order
+	})
+	return candidates[0].encoding
+}
+
+// compressWriter wraps w to compress with the encoding chosen by
+// negotiateEncoding. The returned writer must be closed to flush it.
+func compressWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, encoding)
+}
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "deflate":
+		w = zlib.NewWriter(buf)
+	case "raw-deflate":
+		var err error
+		w, err = flate.NewWriter(buf, flate.DefaultCompression)
+		require.NoError(t, err)
+	case "zstd":
+		var err error
+		w, err = zstd.NewWriter(buf)
+		require.NoError(t, err)
+	case "snappy":
+		w = s2.NewWriter(buf, s2.WriterSnappyCompat())
+	case "snappy-block":
+		return s2.EncodeSnappy(nil, data)
+	default:
+		return data
+	}
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecompressBody(t *testing.T) {
+	body := []byte(in1)
+
+	for _, test := range []struct {
+		name, encoding, header string
+	}{
+		{"identity", "", ""},
+		{"gzip", "gzip", "gzip"},
+		{"deflate", "deflate", "deflate"},
+		{"raw deflate", "raw-deflate", "deflate"},
+		{"zstd", "zstd", "zstd"},
+		{"snappy stream", "snappy", "snappy"},
+		{"snappy block", "snappy-block", "snappy"},
+		{"header case", "gzip", " GZIP "},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, closeBody, err := decompressBody(test.header, bytes.NewReader(compress(t, test.encoding, body)), 0)
+			require.NoError(t, err)
+			defer closeBody()
+
+			decoded, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, body, decoded)
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, _, err := decompressBody("br", strings.NewReader(""), 0)
+		assert.True(t, errors.Is(err, ErrUnsupportedEncoding))
+	})
+}
+
+func TestDecompressBodyBomb(t *testing.T) {
+	bomb := bytes.Repeat([]byte("a"), 1<<20)
+
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate", "zstd", "snappy", "snappy-block"} {
+		t.Run(encoding, func(t *testing.T) {
+			header := strings.TrimSuffix(encoding, "-block")
+			header = strings.TrimPrefix(header, "raw-")
+			r, closeBody, err := decompressBody(header, bytes.NewReader(compress(t, encoding, bomb)), 1024)
+			if err == nil {
+				defer closeBody()
+				_, err = io.ReadAll(r)
+			}
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrPushLimitExceeded), err.Error())
+		})
+	}
+}
+
+func TestSnappyBlockCompressedLimit(t *testing.T) {
+	// the declared length is small, but the block is read before it's checked
+	block := append(s2.EncodeSnappy(nil, []byte("a")), bytes.Repeat([]byte{0}, 1<<20)...)
+
+	_, _, err := decompressBody("snappy", bytes.NewReader(block), 1024)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPushLimitExceeded), err.Error())
+}
+
+func TestLimitedBodyReader(t *testing.T) {
+	r := &limitedBodyReader{r: strings.NewReader("12345"), remaining: 5, max: 5}
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	r = &limitedBodyReader{r: strings.NewReader("123456"), remaining: 5, max: 5}
+	data, err = io.ReadAll(r)
+	assert.EqualError(t, err, "push limit exceeded: decompressed body is larger than 5 bytes")
+	assert.Equal(t, "12345", string(data))
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, test := range []struct {
+		header, expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip, zstd", "zstd"},
+		{"gzip;q=1.0, zstd;q=0.5", "gzip"},
+		{"zstd;q=0, gzip;q=0.1", "gzip"},
+		{"GZIP", "gzip"},
+		{"br", ""},
+	} {
+		t.Run(test.header, func(t *testing.T) {
+			assert.Equal(t, test.expected, negotiateEncoding(test.header))
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// enrichedUnknown is the value of enriched labels that couldn't be
+	// worked out for a request
+	enrichedUnknown = "unknown"
+	// enrichedOther replaces values that aren't in an enricher's allowlist
+	enrichedOther = "other"
+)
+
+// enricher works out the value of a label from a push request
+type enricher func(c *gin.Context) (string, bool)
+
+// Enrichment adds a label clients can't forge to every pushed series,
+// limited to the allowed values when there are any
+type Enrichment struct {
+	Enricher string
+	Label    string
+	Allowed  map[string]struct{}
+
+	enrich enricher
+}
+
+// Enrichments are applied to pushes in order
+type Enrichments []Enrichment
+
+// ParseEnrichments parses enricher=label specs, optionally followed by
+// :value|value... to limit the values of the label. geoipPath is the
+// path to a MaxMind database, needed by the geoip_country enricher.
+func ParseEnrichments(specs []string, geoipPath string) (Enrichments, error) {
+	var (
+		enrichments Enrichments
+		geoip       *geoipDatabase
+	)
+	for _, spec := range specs {
+		name, rest, found := strings.Cut(spec, "=")
+		if !found {
+			return nil, fmt.Errorf("enrichment %q must be enricher=label", spec)
+		}
+		label, values, _ := strings.Cut(rest, ":")
+		if !model.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q for enricher %s", label, name)
+		}
+
+		e := Enrichment{Enricher: name, Label: label}
+		if values != "" {
+			e.Allowed = map[string]struct{}{}
+			for _, value := range strings.Split(values, "|") {
+				e.Allowed[value] = struct{}{}
+			}
+		}
+
+		switch name {
+		case "geoip_country":
+			if geoip == nil {
+				if geoipPath == "" {
+					return nil, errors.New("the geoip_country enricher needs a geoip database")
+				}
+				var err error
+				if geoip, err = openGeoIPDatabase(geoipPath); err != nil {
+					return nil, err
+				}
+			}
+			e.enrich = geoipCountry(geoip)
+		case "user_agent_family":
+			e.enrich = userAgentFamily
+		case "user_agent_os":
+			e.enrich = userAgentOS
+		case "identity":
+			// identities are as many as the users and tokens, or unbounded
+			// with JWTs
+			if e.Allowed == nil {
+				return nil, fmt.Errorf("the identity enricher needs a value allowlist to keep the cardinality of %s bounded", label)
+			}
+			e.enrich = identity
+		default:
+			return nil, fmt.Errorf("unknown enricher %q", name)
+		}
+		enrichments = append(enrichments, e)
+	}
+	return enrichments, nil
+}
+
+func SetEnrichments(enrichments Enrichments) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.enrichments = enrichments
+	}
+}
+
+// labels works out the value of every enriched label for a request
+func (es Enrichments) labels(c *gin.Context) map[string]string {
+	labels := make(map[string]string, len(es))
+	for _, e := range es {
+		value, ok := e.enrich(c)
+		if !ok {
+			value = enrichedUnknown
+		} else if _, allowed := e.Allowed[value]; e.Allowed != nil && !allowed {
+			value = enrichedOther
+		}
+		labels[e.Label] = value
+	}
+	return labels
+}
+
+// apply adds the enriched labels to the labels from PushLabelsKey, so they
+// replace path and query labels of the same name. A label of the same name
+// on a pushed series is a conflict handled by the label conflict policy, so
+// by default it fails the push, except that the enriched value wins even
+// when the series label would. Labels already set by authentication take
+// precedence.
+func (es Enrichments) apply(c *gin.Context) {
+	if len(es) == 0 {
+		return
+	}
+
+	labels := es.labels(c)
+	for name, value := range contextLabels(c) {
+		labels[name] = value
+	}
+	c.Set(PushLabelsKey, labels)
+}
+
+func identity(c *gin.Context) (string, bool) {
+	user := c.GetString(gin.AuthUserKey)
+	return user, user != ""
+}
+
+// geoipDatabase looks up countries in a MaxMind format database, such as
+// GeoLite2-Country or GeoIP2-City
+type geoipDatabase struct {
+	reader *maxminddb.Reader
+}
+
+func openGeoIPDatabase(path string) (*geoipDatabase, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open geoip database: %w", err)
+	}
+	return &geoipDatabase{reader: reader}, nil
+}
+
+func (g *geoipDatabase) country(ip net.IP) (string, bool) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.reader.Lookup(ip, &record); err != nil || record.Country.ISOCode == "" {
+		return "", false
+	}
+	return record.Country.ISOCode, true
+}
+
+type countryLookup interface {
+	country(ip net.IP) (string, bool)
+}
+
+// geoipCountry looks up the country of the client's IP. Forwarding headers
+// are only used when the request comes from a trusted proxy, so clients
+// can't forge their country.
+func geoipCountry(lookup countryLookup) enricher {
+	return func(c *gin.Context) (string, bool) {
+		ip := net.ParseIP(c.ClientIP())
+		if ip == nil {
+			return "", false
+		}
+		return lookup.country(ip)
+	}
+}
+
+func userAgentFamily(c *gin.Context) (string, bool) {
+	family, _ := parseUserAgent(c.Request.UserAgent())
+	return family, family != ""
+}
+
+func userAgentOS(c *gin.Context) (string, bool) {
+	_, os := parseUserAgent(c.Request.UserAgent())
+	return os, os != ""
+}
+
+// parseUserAgent picks out the browser family and operating system from a
+// User-Agent header. Only common browsers are told apart, as the labels
+// must have few values; anything else is "Other".
+func parseUserAgent(ua string) (family, os string) {
+	if ua == "" {
+		return "", ""
+	}
+	lower := strings.ToLower(ua)
+
+	switch {
+	case strings.Contains(lower, "bot") || strings.Contains(lower, "crawler") || strings.Contains(lower, "spider"):
+		family = "Bot"
+	case strings.Contains(ua, "Edg/") || strings.Contains(ua, "EdgA/") || strings.Contains(ua, "EdgiOS/"):
+		family = "Edge"
+	case strings.Contains(ua, "OPR/") || strings.Contains(ua, "Opera"):
+		family = "Opera"
+	case strings.Contains(ua, "SamsungBrowser/"):
+		family = "Samsung Internet"
+	case strings.Contains(ua, "Firefox/") || strings.Contains(ua, "FxiOS/"):
+		family = "Firefox"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "CriOS/"):
+		family = "Chrome"
+	case strings.Contains(ua, "Safari/") && strings.Contains(ua, "Version/"):
+		family = "Safari"
+	default:
+		family = "Other"
+	}
+
+	switch {
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		os = "iOS"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	default:
+		os = "Other"
+	}
+
+	return family, os
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCountries map[string]string
+
+func (f fakeCountries) country(ip net.IP) (string, bool) {
+	country, found := f[ip.String()]
+	return country, found
+}
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua     string
+		family string
+		os     string
+	}{
+		{"", "", ""},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36", "Chrome", "Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46", "Edge", "Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15", "Safari", "macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", "Safari", "iOS"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0", "Firefox", "Linux"},
+		{"Mozilla/5.0 (Linux; Android 13; SM-S901B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/22.0 Chrome/111.0.5563.116 Mobile Safari/537.36", "Samsung Internet", "Android"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "Bot", "Other"},
+		{"curl/8.1.2", "Other", "Other"},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.ua), func(t *testing.T) {
+			family, os := parseUserAgent(test.ua)
+			assert.Equal(t, test.family, family)
+			assert.Equal(t, test.os, os)
+		})
+	}
+}
+
+func TestParseEnrichments(t *testing.T) {
+	enrichments, err := ParseEnrichments([]string{"user_agent_family=browser:Chrome|Firefox", "identity=user:ci|deploy"}, "")
+	require.NoError(t, err)
+	require.Len(t, enrichments, 2)
+	assert.Equal(t, "browser", enrichments[0].Label)
+	assert.Equal(t, map[string]struct{}{"Chrome": {}, "Firefox": {}}, enrichments[0].Allowed)
+	assert.Equal(t, map[string]struct{}{"ci": {}, "deploy": {}}, enrichments[1].Allowed)
+
+	for _, test := range []struct {
+		specs         []string
+		geoipDatabase string
+		err           string
+	}{
+		{[]string{"identity"}, "", `enrichment "identity" must be enricher=label`},
+		{[]string{"identity=user-name"}, "", `invalid label name "user-name" for enricher identity`},
+		{[]string{"referrer=site"}, "", `unknown enricher "referrer"`},
+		{[]string{"identity=user"}, "", "the identity enricher needs a value allowlist to keep the cardinality of user bounded"},
+		{[]string{"geoip_country=country"}, "", "the geoip_country enricher needs a geoip database"},
+	} {
+		_, err := ParseEnrichments(test.specs, test.geoipDatabase)
+		assert.EqualError(t, err, test.err)
+	}
+
+	_, err = ParseEnrichments([]string{"geoip_country=country"}, "/does/not/exist.mmdb")
+	assert.ErrorContains(t, err, "unable to open geoip database")
+}
+
+func TestEnrichmentsApply(t *testing.T) {
+	enrichments := Enrichments{
+		{Label: "country", Allowed: map[string]struct{}{"DE": {}, "US": {}}, enrich: geoipCountry(fakeCountries{
+			"10.0.0.1": "DE",
+			"10.0.0.2": "NZ",
+		})},
+		{Label: "browser", enrich: userAgentFamily},
+		{Label: "tenant", enrich: identity},
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		ua       string
+		user     string
+		context  map[string]string
+		expected map[string]string
+	}{
+		{"allowed values", "10.0.0.1:1234", "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0", "acme", nil,
+			map[string]string{"country": "DE", "browser": "Firefox", "tenant": "acme"}},
+		{"values outside the allowlist", "10.0.0.2:1234", "curl/8.1.2", "acme", nil,
+			map[string]string{"country": "other", "browser": "Other", "tenant": "acme"}},
+		{"values that can't be worked out", "10.0.0.3:1234", "", "", nil,
+			map[string]string{"country": "unknown", "browser": "unknown", "tenant": "unknown"}},
+		{"verified labels take precedence", "10.0.0.1:1234", "curl/8.1.2", "acme", map[string]string{"tenant": "verified"},
+			map[string]string{"country": "DE", "browser": "Other", "tenant": "verified"}},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/metrics", nil)
+			c.Request.RemoteAddr = test.remote
+			c.Request.Header.Set("User-Agent", test.ua)
+			if test.user != "" {
+				c.Set(gin.AuthUserKey, test.user)
+			}
+			if test.context != nil {
+				c.Set(PushLabelsKey, test.context)
+			}
+
+			enrichments.apply(c)
+			assert.Equal(t, test.expected, contextLabels(c))
+		})
+	}
+}
+
+func TestGeoIPCountryForwardedFor(t *testing.T) {
+	enrich := geoipCountry(fakeCountries{
+		"10.0.0.1": "DE",
+		"10.0.0.2": "NZ",
+	})
+
+	for _, test := range []struct {
+		name     string
+		trusted  []string
+		remote   string
+		expected string
+	}{
+		{"untrusted client", nil, "10.0.0.1:1234", "DE"},
+		{"trusted proxy", []string{"10.0.0.1"}, "10.0.0.1:1234", "NZ"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, r := gin.CreateTestContext(httptest.NewRecorder())
+			require.NoError(t, r.SetTrustedProxies(test.trusted))
+			c.Request = httptest.NewRequest("POST", "/metrics", nil)
+			c.Request.RemoteAddr = test.remote
+			c.Request.Header.Set("X-Forwarded-For", "10.0.0.2")
+
+			country, ok := enrich(c)
+			assert.True(t, ok)
+			assert.Equal(t, test.expected, country)
+		})
+	}
+}
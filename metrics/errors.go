@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/expfmt"
+)
+
+// errorCategory tells clients what kind of problem made a push fail
+type errorCategory string
+
+const (
+	categoryParse           errorCategory = "parse"
+	categoryTypeConflict    errorCategory = "type_conflict"
+	categoryDuplicateLabels errorCategory = "duplicate_labels"
+	categoryInvalidName     errorCategory = "invalid_name"
+	categoryInvalidValue    errorCategory = "invalid_value"
+	categoryLimit           errorCategory = "limit"
+	categoryEncoding        errorCategory = "encoding"
+	categoryForbidden       errorCategory = "forbidden"
+	categoryIdempotency     errorCategory = "idempotency"
+	categoryUnavailable     errorCategory = "unavailable"
+)
+
+// categorizedError attaches a category to an error without changing its
+// message
+type categorizedError struct {
+	category errorCategory
+	err      error
+}
+
+func (e *categorizedError) Error() string { return e.err.Error() }
+func (e *categorizedError) Unwrap() error { return e.err }
+
+func categorize(category errorCategory, err error) error {
+	return &categorizedError{category: category, err: err}
+}
+
+func categoryOf(err error) errorCategory {
+	var categorized *categorizedError
+	switch {
+	case errors.As(err, &categorized):
+		return categorized.category
+	case errors.Is(err, ErrPushLimitExceeded):
+		return categoryLimit
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return categoryEncoding
+	}
+	return categoryParse
+}
+
+// pushError describes one problem with a push. Line is the line of the
+// body the problem was found on, when it is known.
+type pushError struct {
+	Family   string        `json:"family,omitempty"`
+	Line     int           `json:"line,omitempty"`
+	Category errorCategory `json:"category"`
+	Error    string        `json:"error"`
+
+	err error
+}
+
+func newPushError(family string, err error) pushError {
+	pe := pushError{
+		Family:   family,
+		Category: categoryOf(err),
+		Error:    err.Error(),
+		err:      err,
+	}
+
+	var parseErr expfmt.ParseError
+	if errors.As(err, &parseErr) {
+		pe.Line = parseErr.Line
+	}
+	return pe
+}
+
+// pushErrorResponse is the JSON body of a failed push
+type pushErrorResponse struct {
+	Error  string      `json:"error"`
+	Errors []pushError `json:"errors"`
+}
+
+// acceptsJSON reports whether the client explicitly asked for JSON, so
+// clients that send no Accept header keep getting plain text
+func acceptsJSON(c *gin.Context) bool {
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), gin.MIMEJSON) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePushErrors responds with every problem found with a push, as JSON
+// for clients that accept it and as one line per problem otherwise
+func writePushErrors(c *gin.Context, status int, errs ...pushError) {
+	if acceptsJSON(c) {
+		c.JSON(status, pushErrorResponse{
+			Error:  http.StatusText(status),
+			Errors: errs,
+		})
+		return
+	}
+
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Error)
+	}
+	http.Error(c.Writer, strings.Join(messages, "\n"), status)
+}
+
+// addFamilyLines fills in the line of the body each family starts on, for
+// errors that were found after parsing
+func addFamilyLines(body []byte, errs []pushError) {
+	wanted := map[string]int{}
+	for _, e := range errs {
+		if e.Family != "" && e.Line == 0 {
+			wanted[e.Family] = 0
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		name := familyOfLine(scanner.Text())
+		if line, ok := wanted[name]; ok && line == 0 {
+			wanted[name] = lineNumber
+		}
+	}
+
+	for i := range errs {
+		if line, ok := wanted[errs[i].Family]; ok && errs[i].Line == 0 {
+			errs[i].Line = line
+		}
+	}
+}
+
+// familyOfLine returns the family a line of the text format belongs to.
+// Samples of histograms and summaries are returned under their suffixed
+// names, but those families always start with a TYPE line.
+func familyOfLine(line string) string {
+	line = strings.TrimSpace(line)
+	if rest, found := strings.CutPrefix(line, "#"); found {
+		fields := strings.Fields(rest)
+		if len(fields) >= 2 && (fields[0] == "TYPE" || fields[0] == "HELP") {
+			return fields[1]
+		}
+		return ""
+	}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return line
+	}
+	return line[:end]
+}
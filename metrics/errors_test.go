@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCategoryOf(t *testing.T) {
+	_, parseErr := parseFamilies(strings.NewReader("a{ 1\n"))
+	require.Error(t, parseErr)
+
+	tests := []struct {
+		name     string
+		err      error
+		category errorCategory
+	}{
+		{"parse", parseErr, categoryParse},
+		{"limit", limitError("too big"), categoryLimit},
+		{"encoding", fmt.Errorf("%w %q", ErrUnsupportedEncoding, "br"), categoryEncoding},
+		{"categorized", categorize(categoryTypeConflict, errors.New("conflict")), categoryTypeConflict},
+		{"wrapped", fmt.Errorf("wrapped: %w", categorize(categoryForbidden, errors.New("no"))), categoryForbidden},
+		{"unknown", errors.New("something"), categoryParse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.category, categoryOf(test.err))
+		})
+	}
+
+	assert.Equal(t, 1, newPushError("", parseErr).Line)
+}
+
+func TestValidateFamilyCategories(t *testing.T) {
+	families, err := parseFamilies(strings.NewReader("a{x=\"1\"} 1\na{x=\"1\"} 2\n"))
+	require.NoError(t, err)
+	assert.Equal(t, categoryDuplicateLabels, categoryOf(validateFamily(families["a"])))
+
+	invalidValue := &dto.MetricFamily{
+		Name: proto.String("b"),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("x"), Value: proto.String("\xff")}},
+		}},
+	}
+	assert.Equal(t, categoryInvalidValue, categoryOf(validateFamily(invalidValue)))
+
+	invalidName := &dto.MetricFamily{
+		Name: proto.String("c"),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("0x"), Value: proto.String("1")}},
+		}},
+	}
+	assert.Equal(t, categoryInvalidName, categoryOf(validateFamily(invalidName)))
+}
+
+func TestAddFamilyLines(t *testing.T) {
+	body := []byte(`# HELP a A counter
+# TYPE a counter
+a 1
+
+b{x="1"} 1
+# TYPE c histogram
+c_bucket{le="+Inf"} 1
+`)
+	errs := []pushError{
+		{Family: "a"},
+		{Family: "b"},
+		{Family: "c"},
+		{Family: "missing"},
+		{Family: "a", Line: 10},
+	}
+
+	addFamilyLines(body, errs)
+
+	assert.Equal(t, 1, errs[0].Line)
+	assert.Equal(t, 5, errs[1].Line)
+	assert.Equal(t, 6, errs[2].Line)
+	assert.Equal(t, 0, errs[3].Line)
+	assert.Equal(t, 10, errs[4].Line)
+}
@@ -0,0 +1,213 @@
+package metrics
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// IdempotencyKeyHeader lets clients retry a push without it being merged
+	// twice
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader marks responses replayed for a retried push
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	ErrIdempotencyKeyTooLong  = errors.New("idempotency key is longer than 255 bytes")
+	ErrIdempotencyKeyInFlight = errors.New("a push with this idempotency key is still being processed")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key was already used for a different push")
+)
+
+// SetIdempotency remembers the Idempotency-Key of pushes for ttl, so retries
+// get the original response without being merged again. At most maxKeys are
+// remembered, forgetting the oldest first. A zero ttl disables it.
+func SetIdempotency(ttl time.Duration, maxKeys int) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		if ttl <= 0 || maxKeys <= 0 {
+			a.idempotency = nil
+			return
+		}
+		a.idempotency = newIdempotencyCache(ttl, maxKeys)
+	}
+}
+
+// idempotentPush is the outcome of a push, kept to answer its retries
+type idempotentPush struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+
+	// done is false while the first push is still being processed
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+}
+
+// idempotencyCache is a bounded cache of recent pushes by idempotency key
+type idempotencyCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	maxKeys int
+	// pushes are kept in the order they were made, so the oldest are both
+	// the first to expire and the first to be evicted
+	order  *list.List
+	pushes map[string]*list.Element
+	now    func() time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, maxKeys int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		order:   list.New(),
+		pushes:  map[string]*list.Element{},
+		now:     time.Now,
+	}
+}
+
+// begin returns the push already made with key, or records a new one in
+// flight and returns nil
+func (ic *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) *idempotentPush {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	now := ic.now()
+	ic.expire(now)
+
+	if element, ok := ic.pushes[key]; ok {
+		push := *element.Value.(*idempotentPush)
+		return &push
+	}
+
+	ic.pushes[key] = ic.order.PushBack(&idempotentPush{
+		key:         key,
+		fingerprint: fingerprint,
+		expires:     now.Add(ic.ttl),
+	})
+	for ic.order.Len() > ic.maxKeys {
+		ic.remove(ic.order.Front())
+	}
+	IdempotencyKeys.Set(float64(ic.order.Len()))
+
+	return nil
+}
+
+// finish records the response to a push so it can be replayed. Pushes
+// that failed on the gateway's side, like those turned away while it was
+// busy or short of memory, are forgotten instead, so they can be retried
+// with the same key.
+func (ic *idempotencyCache) finish(key string, status int, contentType string, body []byte) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	element, ok := ic.pushes[key]
+	if !ok {
+		// evicted while it was being processed
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		ic.remove(element)
+		IdempotencyKeys.Set(float64(ic.order.Len()))
+		return
+	}
+	push := element.Value.(*idempotentPush)
+	push.done = true
+	push.status = status
+	push.contentType = contentType
+	push.body = body
+}
+
+func (ic *idempotencyCache) expire(now time.Time) {
+	for element := ic.order.Front(); element != nil; element = ic.order.Front() {
+		if element.Value.(*idempotentPush).expires.After(now) {
+			break
+		}
+		ic.remove(element)
+	}
+	IdempotencyKeys.Set(float64(ic.order.Len()))
+}
+
+func (ic *idempotencyCache) remove(element *list.Element) {
+	ic.order.Remove(element)
+	delete(ic.pushes, element.Value.(*idempotentPush).key)
+}
+
+// idempotencyResponseWriter keeps a copy of the response to a push
+type idempotencyResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// handleIdempotencyKey answers retries of a push with the response to the
+// original push and returns true. Otherwise it returns false, and the
+// returned function must be called once the push has been answered.
+func (a *Aggregate) handleIdempotencyKey(c *gin.Context, body []byte) (bool, func()) {
+	noop := func() {}
+
+	idempotencyKey := c.GetHeader(IdempotencyKeyHeader)
+	if a.idempotency == nil || idempotencyKey == "" {
+		return false, noop
+	}
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		writePushErrors(c, http.StatusBadRequest, newPushError("", categorize(categoryIdempotency, ErrIdempotencyKeyTooLong)))
+		return true, noop
+	}
+
+	// keys are only unique per client, and the same key must not be used
+	// for a different push
+	key := c.GetString(gin.AuthUserKey) + "\x00" + idempotencyKey
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\x00"))
+	hash.Write(body)
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], hash.Sum(nil))
+
+	push := a.idempotency.begin(key, fingerprint)
+	if push == nil {
+		recorder := &idempotencyResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		return false, func() {
+			a.idempotency.finish(key, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		}
+	}
+
+	switch {
+	case push.fingerprint != fingerprint:
+		writePushErrors(c, http.StatusUnprocessableEntity, newPushError("", categorize(categoryIdempotency, ErrIdempotencyKeyReused)))
+	case !push.done:
+		writePushErrors(c, http.StatusConflict, newPushError("", categorize(categoryIdempotency, ErrIdempotencyKeyInFlight)))
+	default:
+		DeduplicatedPushes.Inc()
+		c.Header(idempotentReplayedHeader, "true")
+		if push.contentType != "" {
+			c.Header("Content-Type", push.contentType)
+		}
+		c.Status(push.status)
+		if _, err := c.Writer.Write(push.body); err != nil {
+			log.Printf("unable to replay push response: %v", err)
+		}
+	}
+	return true, noop
+}
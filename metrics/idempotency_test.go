@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newIdempotencyCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	fingerprint := sha256.Sum256([]byte("push"))
+
+	require.Nil(t, cache.begin("a", fingerprint))
+
+	push := cache.begin("a", fingerprint)
+	require.NotNil(t, push)
+	assert.False(t, push.done)
+
+	cache.finish("a", 202, "", nil)
+	push = cache.begin("a", fingerprint)
+	require.NotNil(t, push)
+	assert.True(t, push.done)
+	assert.Equal(t, 202, push.status)
+
+	// the oldest key is evicted once there are too many
+	require.Nil(t, cache.begin("b", fingerprint))
+	require.Nil(t, cache.begin("c", fingerprint))
+	assert.Nil(t, cache.begin("a", fingerprint))
+
+	// finishing an evicted push is ignored
+	cache.finish("b", 202, "", nil)
+	cache.finish("missing", 202, "", nil)
+
+	// and keys expire after the ttl
+	now = now.Add(time.Minute)
+	assert.Nil(t, cache.begin("c", fingerprint))
+	assert.Equal(t, 1, cache.order.Len())
+
+	// pushes turned away while busy can be retried with the same key
+	cache.finish("c", 503, "", nil)
+	assert.Nil(t, cache.begin("c", fingerprint))
+	// as can any other failure of the gateway's own
+	cache.finish("c", 507, "", nil)
+	assert.Nil(t, cache.begin("c", fingerprint))
+}
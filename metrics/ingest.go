@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxIngestBatch is the most queued pushes a worker merges at once
+const maxIngestBatch = 64
+
+var (
+	ErrIngestQueueFull   = errors.New("too many pushes are waiting to be merged, retry later")
+	ErrIngestQueueClosed = errors.New("the gateway is shutting down, retry later")
+)
+
+// queuedPush is a validated push waiting to be merged. Unless partial is
+// set, it is merged all at once or not at all.
+type queuedPush struct {
+	families map[string]*dto.MetricFamily
+	partial  bool
+	enqueued time.Time
+}
+
+// ingestQueue is a bounded queue of validated pushes, merged in batches by a
+// pool of workers
+type ingestQueue struct {
+	pushes  chan queuedPush
+	workers int
+
+	// closing is held for reading while pushes are queued, so the queue
+	// isn't closed under them
+	closing sync.RWMutex
+	closed  bool
+	running sync.WaitGroup
+}
+
+// SetIngestQueue makes pushes be validated on the request and merged later
+// by workers, answering once they are queued. At most size pushes wait to
+// be merged, and pushes are turned away when the queue is full. A zero size
+// merges pushes before answering.
+func SetIngestQueue(size, workers int) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		if size <= 0 {
+			a.ingest = nil
+			return
+		}
+		if workers <= 0 {
+			workers = 1
+		}
+		a.ingest = &ingestQueue{pushes: make(chan queuedPush, size), workers: workers}
+	}
+}
+
+func (q *ingestQueue) start(a *Aggregate) {
+	q.running.Add(q.workers)
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			defer q.running.Done()
+			q.work(a)
+		}()
+	}
+}
+
+// enqueue adds a push to the queue, failing if the queue is full or closed
+func (q *ingestQueue) enqueue(families map[string]*dto.MetricFamily, partial bool) error {
+	q.closing.RLock()
+	defer q.closing.RUnlock()
+	if q.closed {
+		return categorize(categoryUnavailable, ErrIngestQueueClosed)
+	}
+
+	select {
+	case q.pushes <- queuedPush{families: families, partial: partial, enqueued: time.Now()}:
+		IngestQueueDepth.Set(float64(len(q.pushes)))
+		return nil
+	default:
+		IngestQueueFull.Inc()
+		return categorize(categoryUnavailable, ErrIngestQueueFull)
+	}
+}
+
+// close turns away new pushes and waits for the workers to merge the
+// queued ones
+func (q *ingestQueue) close() {
+	q.closing.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pushes)
+	}
+	q.closing.Unlock()
+	q.running.Wait()
+}
+
+// Close drains the ingest queue, merging every queued push before
+// returning. Pushes made afterwards are turned away if they would be queued.
+func (a *Aggregate) Close() {
+	if a.ingest != nil {
+		a.ingest.close()
+	}
+}
+
+// work merges queued pushes, taking whatever else is already waiting along
+// with each one so every family is merged once per batch
+func (q *ingestQueue) work(a *Aggregate) {
+	for push := range q.pushes {
+		batch := []queuedPush{push}
+	drain:
+		for len(batch) < maxIngestBatch {
+			select {
+			case push := <-q.pushes:
+				batch = append(batch, push)
+			default:
+				break drain
+			}
+		}
+		IngestQueueDepth.Set(float64(len(q.pushes)))
+
+		a.mergeBatch(batch)
+
+		now := time.Now()
+		for _, push := range batch {
+			IngestQueueLatency.Observe(now.Sub(push.enqueued).Seconds())
+		}
+	}
+}
+
+// enqueuePush validates a push and queues its valid families to be merged.
+// Families that would be rejected by the merge as things stand, for their
+// type or for adding series past the memory soft limit, are rejected now so
+// the client hears about them. Unless partial is set, nothing is queued once
+// any family is rejected.
+func (a *Aggregate) enqueuePush(inFamilies map[string]*dto.MetricFamily, labels []labelPair, partial bool) (pushResult, error) {
+	result := pushResult{Accepted: []string{}, Rejected: []pushError{}}
+	valid := a.prepareFamilies(inFamilies, labels, &result)
+	valid = a.checkQueuedFamilies(inFamilies, valid, &result)
+	if len(valid) == 0 || (len(result.Rejected) > 0 && !partial) {
+		return result, nil
+	}
+
+	families := make(map[string]*dto.MetricFamily, len(valid))
+	for _, name := range valid {
+		families[name] = inFamilies[name]
+	}
+	if err := a.ingest.enqueue(families, partial); err != nil {
+		return result, err
+	}
+	result.Accepted = valid
+	return result, nil
+}
+
+// checkQueuedFamilies rejects the valid families of a push that the merge
+// would reject with the families stored now, and returns the rest. Nothing
+// is changed, so a family may still be rejected if the stored ones change
+// before it is merged.
+func (a *Aggregate) checkQueuedFamilies(inFamilies map[string]*dto.MetricFamily, valid []string, result *pushResult) []string {
+	touched := make([]string, 0, 2*len(valid))
+	for _, name := range valid {
+		touched = append(touched, name, keepBothName(inFamilies[name]))
+	}
+	locked := a.families.shardsOf(touched...)
+	a.families.lock(locked)
+	defer a.families.unlock(locked)
+
+	overSoftLimit := a.memory.overSoftLimit()
+	checked := make([]string, 0, len(valid))
+	for _, name := range valid {
+		family := inFamilies[name]
+		target, _ := a.families.lookup(name)
+		if target != nil {
+			if err := target.checkType(family); err != nil {
+				switch a.typeConflictResolution(target, family) {
+				case TypeConflictReject:
+					a.conflicts.record(resolvedConflict{
+						family:     name,
+						stored:     target.GetType(),
+						pushed:     family.GetType(),
+						resolution: TypeConflictReject,
+					})
+					result.reject(name, categorize(categoryTypeConflict, err))
+					continue
+				case TypeConflictReplace:
+					target = nil
+				case TypeConflictKeepBoth:
+					target, _ = a.families.lookup(keepBothName(family))
+				}
+			}
+		}
+		if overSoftLimit {
+			if added := newSeriesCount(target, family); added > 0 {
+				MemoryRejectedSeries.Add(float64(added))
+				result.reject(name, a.memory.softLimitError())
+				continue
+			}
+		}
+		checked = append(checked, name)
+	}
+	sortRejections(result.Rejected)
+	return checked
+}
+
+// mergeBatch merges several queued pushes at once, combining the series of
+// the families they share. If the combined pushes can't all be merged, as
+// when a family is pushed with different types within the batch, each push
+// is merged on its own instead, so a push is still merged all at once unless
+// it was partial.
+func (a *Aggregate) mergeBatch(batch []queuedPush) {
+	if len(batch) > 1 {
+		if families, names, ok := combinePushes(batch); ok {
+			result := pushResult{}
+			a.storeFamilies(families, names, nil, false, false, &result)
+			if len(result.Accepted) > 0 || len(result.Rejected) == 0 {
+				a.conflicts.record(result.conflicts...)
+				logQueuedRejections(result)
+				return
+			}
+		}
+	}
+
+	for _, push := range batch {
+		result := pushResult{}
+		a.storeFamilies(push.families, sortedFamilyNames(push.families), nil, push.partial, false, &result)
+		a.conflicts.record(result.conflicts...)
+		logQueuedRejections(result)
+	}
+}
+
+// combinePushes merges the families of several pushes into one push,
+// returning false if a family is pushed with different types. The pushed
+// families are left as they were, so the pushes can still be merged on
+// their own.
+func combinePushes(batch []queuedPush) (map[string]*dto.MetricFamily, []string, bool) {
+	combined := map[string]*metricFamily{}
+	for _, push := range batch {
+		for _, name := range sortedFamilyNames(push.families) {
+			family := push.families[name]
+			copied := &dto.MetricFamily{
+				Name:   family.Name,
+				Help:   family.Help,
+				Type:   family.Type,
+				Metric: append([]*dto.Metric(nil), family.Metric...),
+			}
+			existing, ok := combined[name]
+			if !ok {
+				combined[name] = newMetricFamily(copied, nil)
+				continue
+			}
+			if err := existing.mergeFamily(copied); err != nil {
+				return nil, nil, false
+			}
+		}
+	}
+
+	families := make(map[string]*dto.MetricFamily, len(combined))
+	for name, family := range combined {
+		families[name] = family.snapshot()
+	}
+	return families, sortedFamilyNames(families), true
+}
+
+func sortedFamilyNames(families map[string]*dto.MetricFamily) []string {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func logQueuedRejections(result pushResult) {
+	for _, rejected := range result.Rejected {
+		log.Printf("unable to merge queued push of %s: %s", rejected.Family, rejected.Error)
+	}
+	IngestRejectedFamilies.Add(float64(len(result.Rejected)))
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeBatch(t *testing.T) {
+	a := NewAggregate()
+	gauge := &dto.MetricFamily{
+		Name:   strPtr("requests"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: float64ptr(7)}}},
+	}
+
+	a.mergeBatch([]queuedPush{
+		{families: map[string]*dto.MetricFamily{"requests": counterFamily("requests", counterSeries(1, "code", "200"))}},
+		{families: map[string]*dto.MetricFamily{"requests": counterFamily("requests", counterSeries(2, "code", "200"), counterSeries(3, "code", "500"))}},
+		// a conflicting type in the batch is rejected like a separate push
+		{families: map[string]*dto.MetricFamily{"requests": gauge}},
+		{families: map[string]*dto.MetricFamily{"requests": counterFamily("requests", counterSeries(4, "code", "500"))}},
+	})
+
+	buf := new(bytes.Buffer)
+	a.encodeAllMetrics(buf, expfmt.FmtText)
+	assert.Equal(t, "# TYPE requests counter\nrequests{code=\"200\"} 3\nrequests{code=\"500\"} 7\n", buf.String())
+}
+
+func TestEnqueuePush(t *testing.T) {
+	a := NewAggregate()
+	// the queue's workers aren't started, so pushes stay queued
+	SetIngestQueue(1, 1)(a)
+
+	result, err := a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1, "code", "200")),
+	}, testLabels, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"requests"}, result.Accepted)
+	assert.Len(t, a.ingest.pushes, 1)
+
+	// invalid pushes are rejected without being queued
+	result, err = a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1, "job", "other")),
+	}, testLabels, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Accepted)
+	assert.Len(t, result.Rejected, 1)
+
+	_, err = a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1, "code", "500")),
+	}, testLabels, false)
+	assert.ErrorIs(t, err, ErrIngestQueueFull)
+	assert.Equal(t, categoryUnavailable, categoryOf(err))
+}
+
+func TestEnqueuePushChecksStoredFamilies(t *testing.T) {
+	a := NewAggregate(SetMemoryBudget(1, 0))
+	SetIngestQueue(10, 1)(a)
+	require.NoError(t, a.mergeFamilies(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1, "code", "200")),
+	}, testLabels))
+
+	// a type conflict is rejected before the push is queued
+	result, err := a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": {
+			Name:   strPtr("requests"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: float64ptr(7)}}},
+		},
+	}, testLabels, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Accepted)
+	require.Len(t, result.Rejected, 1)
+	assert.Equal(t, categoryTypeConflict, categoryOf(result.Rejected[0].err))
+
+	// so are new series past the memory soft limit, while stored series can
+	// still be updated
+	result, err = a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1, "code", "500")),
+	}, testLabels, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Accepted)
+	require.Len(t, result.Rejected, 1)
+	assert.ErrorIs(t, result.Rejected[0].err, ErrMemoryBudgetExceeded)
+
+	result, err = a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1, "code", "200")),
+	}, testLabels, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"requests"}, result.Accepted)
+	assert.Len(t, a.ingest.pushes, 1)
+}
+
+func TestMergeBatchAtomic(t *testing.T) {
+	for idx, test := range []struct {
+		name     string
+		partial  bool
+		expected string
+	}{
+		{"whole push rejected", false, "# TYPE errors gauge\nerrors 7\n# TYPE requests counter\nrequests 5\n"},
+		{"partial push", true, "# TYPE errors gauge\nerrors 7\n# TYPE requests counter\nrequests 6\n"},
+	} {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			a := NewAggregate()
+			// errors was created with another type after the push was queued
+			require.NoError(t, a.mergeFamilies(map[string]*dto.MetricFamily{
+				"errors": {
+					Name:   strPtr("errors"),
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: float64ptr(7)}}},
+				},
+			}, nil))
+
+			a.mergeBatch([]queuedPush{
+				{families: map[string]*dto.MetricFamily{
+					"errors":   counterFamily("errors", counterSeries(2)),
+					"requests": counterFamily("requests", counterSeries(1)),
+				}, partial: test.partial},
+				{families: map[string]*dto.MetricFamily{"requests": counterFamily("requests", counterSeries(5))}},
+			})
+
+			buf := new(bytes.Buffer)
+			a.encodeAllMetrics(buf, expfmt.FmtText)
+			assert.Equal(t, test.expected, buf.String())
+		})
+	}
+}
+
+func TestIngestQueueClose(t *testing.T) {
+	a := NewAggregate(SetIngestQueue(100, 2))
+
+	for i := 0; i < 50; i++ {
+		_, err := a.enqueuePush(map[string]*dto.MetricFamily{
+			"requests": counterFamily("requests", counterSeries(1)),
+		}, testLabels, false)
+		require.NoError(t, err)
+	}
+
+	// every queued push is merged by the time Close returns
+	a.Close()
+	buf := new(bytes.Buffer)
+	a.encodeAllMetrics(buf, expfmt.FmtText)
+	assert.Equal(t, "# TYPE requests counter\nrequests{job=\"test\"} 50\n", buf.String())
+
+	_, err := a.enqueuePush(map[string]*dto.MetricFamily{
+		"requests": counterFamily("requests", counterSeries(1)),
+	}, testLabels, false)
+	assert.ErrorIs(t, err, ErrIngestQueueClosed)
+	assert.Equal(t, categoryUnavailable, categoryOf(err))
+
+	// closing again doesn't block or panic
+	a.Close()
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// internShards is the number of shards the intern table is spread over, so
+// pushes to different families rarely wait on the same lock
+const internShards = 32
+
+// internTable shares one copy of each label name and value between every
+// stored series carrying it. Strings are counted by the series using them
+// and dropped once the last of those is removed.
+type internTable struct {
+	shards [internShards]internShard
+}
+
+type internShard struct {
+	lock    sync.Mutex
+	strings map[string]internedString
+}
+
+type internedString struct {
+	value *string
+	refs  int
+}
+
+func newInternTable() *internTable {
+	t := &internTable{}
+	for i := range t.shards {
+		t.shards[i].strings = map[string]internedString{}
+	}
+	return t
+}
+
+func (t *internTable) shard(s string) *internShard {
+	// FNV-1a, inlined to avoid allocating a hash for every string
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+	return &t.shards[hash%internShards]
+}
+
+// intern returns the shared copy of the string p points to, taking a
+// reference to it
+func (t *internTable) intern(p *string) *string {
+	if p == nil {
+		return nil
+	}
+
+	shard := t.shard(*p)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	interned, ok := shard.strings[*p]
+	if !ok {
+		interned.value = p
+		InternedStrings.Inc()
+	}
+	interned.refs++
+	shard.strings[*p] = interned
+	return interned.value
+}
+
+// release drops a reference taken by intern
+func (t *internTable) release(p *string) {
+	if p == nil {
+		return
+	}
+
+	shard := t.shard(*p)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	interned, ok := shard.strings[*p]
+	if !ok {
+		return
+	}
+	interned.refs--
+	if interned.refs > 0 {
+		shard.strings[*p] = interned
+		return
+	}
+	delete(shard.strings, *p)
+	InternedStrings.Dec()
+}
+
+// internLabels makes labels point at the shared copies of their names and
+// values
+func (t *internTable) internLabels(labels []*dto.LabelPair) {
+	for _, l := range labels {
+		l.Name = t.intern(l.Name)
+		l.Value = t.intern(l.Value)
+	}
+}
+
+func (t *internTable) releaseLabels(labels []*dto.LabelPair) {
+	for _, l := range labels {
+		t.release(l.Name)
+		t.release(l.Value)
+	}
+}
+
+// len returns the number of distinct strings interned
+func (t *internTable) len() int {
+	count := 0
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.lock.Lock()
+		count += len(shard.strings)
+		shard.lock.Unlock()
+	}
+	return count
+}
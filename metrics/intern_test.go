@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternTable(t *testing.T) {
+	table := newInternTable()
+
+	first := table.intern(strPtr("job"))
+	second := table.intern(strPtr("job"))
+	assert.Same(t, first, second)
+	assert.Nil(t, table.intern(nil))
+	assert.Equal(t, 1, table.len())
+
+	table.release(strPtr("job"))
+	assert.Equal(t, 1, table.len())
+	table.release(second)
+	assert.Equal(t, 0, table.len())
+	table.release(strPtr("missing"))
+}
+
+func TestInternedLabels(t *testing.T) {
+	a := NewAggregate()
+
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 1\nrequests{code=\"500\"} 1\n"), testLabels))
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE errors counter\nerrors{code=\"500\"} 1\n"), testLabels))
+	// code, 200, 500, job and test
+	assert.Equal(t, 5, a.tracker.interned.len())
+
+	a.families.lock(a.families.all())
+	requests, _ := a.families.lookup("requests")
+	errors, _ := a.families.lookup("errors")
+	a.families.unlock(a.families.all())
+	requestSeries := requests.sortedSeries()
+	errorSeries := errors.sortedSeries()
+	// series of different families share their label strings
+	assert.Same(t, requestSeries[1].Label[0].Value, errorSeries[0].Label[0].Value)
+	assert.Same(t, requestSeries[0].Label[1].Name, errorSeries[0].Label[1].Name)
+
+	// strings are dropped once no stored series uses them
+	a.deleteSeries([]labelPair{{"code", "200"}})
+	assert.Equal(t, 4, a.tracker.interned.len())
+	a.deleteFamily("requests", nil)
+	assert.Equal(t, 4, a.tracker.interned.len())
+	a.deleteFamily("errors", nil)
+	assert.Equal(t, 0, a.tracker.interned.len())
+}
+
+// BenchmarkInternedMemory stores 100k series whose labels repeat the same
+// few values, reporting the heap they use once stored with and without
+// interning
+func BenchmarkInternedMemory(b *testing.B) {
+	const series = 100000
+
+	for _, interned := range []bool{false, true} {
+		b.Run(fmt.Sprintf("interned_%t", interned), func(b *testing.B) {
+			var stats runtime.MemStats
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				before := stats.HeapAlloc
+
+				families := make([]*dto.MetricFamily, 0, series/1000)
+				for f := 0; f < series/1000; f++ {
+					family := counterFamily(fmt.Sprintf("family_%d", f))
+					for i := 0; i < 1000; i++ {
+						// every string is allocated separately, as it is
+						// when parsed
+						labels := []string{
+							"code", fmt.Sprint(200 + i%5),
+							"instance", fmt.Sprintf("instance-%d", i),
+							"job", "web",
+							"region", "eu-west-1",
+						}
+						for l := range labels {
+							labels[l] = strings.Clone(labels[l])
+						}
+						family.Metric = append(family.Metric, counterSeries(1, labels...))
+					}
+					families = append(families, family)
+				}
+				b.StartTimer()
+				a := NewAggregate()
+				if !interned {
+					a.tracker.interned = nil
+				}
+				for _, family := range families {
+					if err := a.mergeFamilies(map[string]*dto.MetricFamily{family.GetName(): family}, nil); err != nil {
+						b.Fatalf("unexpected error %s", err)
+					}
+				}
+				b.StopTimer()
+
+				families = nil
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				b.ReportMetric(float64(int64(stats.HeapAlloc)-int64(before))/series, "heap-bytes/series")
+				runtime.KeepAlive(a)
+			}
+		})
+	}
+}
@@ -12,14 +12,76 @@ func strPtr(s string) *string {
 	return &s
 }
 
-func addLabels(m *dto.Metric, labels []labelPair) error {
-	set := make(map[string]struct{}, len(m.Label))
+// LabelConflictPolicy decides what happens when a label from the path is
+// also on a pushed series
+type LabelConflictPolicy string
+
+const (
+	// LabelConflictReject rejects the push
+	LabelConflictReject LabelConflictPolicy = "reject"
+	// LabelConflictPathWins replaces the value on the series with the one
+	// from the path, like the pushgateway
+	LabelConflictPathWins LabelConflictPolicy = "path"
+	// LabelConflictBodyWins keeps the value on the series
+	LabelConflictBodyWins LabelConflictPolicy = "body"
+	// LabelConflictRename renames the label on the series to
+	// exported_<name>, like Prometheus does without honor_labels
+	LabelConflictRename LabelConflictPolicy = "rename"
+)
+
+const exportedLabelPrefix = "exported_"
+
+var labelConflictPolicies = []LabelConflictPolicy{
+	LabelConflictReject,
+	LabelConflictPathWins,
+	LabelConflictBodyWins,
+	LabelConflictRename,
+}
+
+// ParseLabelConflictPolicy parses a policy name, defaulting to reject when
+// it is empty
+func ParseLabelConflictPolicy(value string) (LabelConflictPolicy, error) {
+	if value == "" {
+		return LabelConflictReject, nil
+	}
+	for _, policy := range labelConflictPolicies {
+		if string(policy) == value {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown label conflict policy %q", value)
+}
+
+func SetLabelConflictPolicy(policy LabelConflictPolicy) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.labelConflictPolicy = policy
+	}
+}
+
+func addLabels(m *dto.Metric, labels []labelPair, policy LabelConflictPolicy) error {
+	set := make(map[string]*dto.LabelPair, len(m.Label))
 	for _, l := range m.Label {
-		set[l.GetName()] = struct{}{}
+		set[l.GetName()] = l
 	}
 	for _, label := range labels {
-		if _, duplicate := set[label.name]; duplicate {
-			return fmt.Errorf("duplicate label %s", label.name)
+		if existing, duplicate := set[label.name]; duplicate {
+			switch policy {
+			case LabelConflictPathWins:
+				existing.Value = strPtr(label.value)
+				continue
+			case LabelConflictBodyWins:
+				continue
+			case LabelConflictRename:
+				exported := exportedLabelPrefix + label.name
+				for set[exported] != nil {
+					exported = exportedLabelPrefix + exported
+				}
+				existing.Name = strPtr(exported)
+				delete(set, label.name)
+				set[exported] = existing
+			default:
+				return fmt.Errorf("duplicate label %s", label.name)
+			}
 		}
 		pair := dto.LabelPair{Name: strPtr(label.name), Value: strPtr(label.value)}
 		m.Label = append(m.Label, &pair)
@@ -29,7 +91,7 @@ func addLabels(m *dto.Metric, labels []labelPair) error {
 }
 
 func (a *Aggregate) formatLabels(m *dto.Metric, labels []labelPair) error {
-	if err := addLabels(m, labels); err != nil {
+	if err := addLabels(m, labels, a.options.labelConflictPolicy); err != nil {
 		return err
 	}
 	sort.Sort(byName(m.Label))
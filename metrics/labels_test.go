@@ -40,6 +40,62 @@ func TestFormatLabels(t *testing.T) {
 	}
 }
 
+func TestFormatLabelsConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy   LabelConflictPolicy
+		expected []*dto.LabelPair
+		err      error
+	}{
+		{LabelConflictReject, nil, fmt.Errorf("duplicate label job")},
+		{LabelConflictPathWins, []*dto.LabelPair{
+			{Name: strPtr("exported_job"), Value: strPtr("old")},
+			{Name: strPtr("job"), Value: strPtr("path")},
+		}, nil},
+		{LabelConflictBodyWins, []*dto.LabelPair{
+			{Name: strPtr("exported_job"), Value: strPtr("old")},
+			{Name: strPtr("job"), Value: strPtr("body")},
+		}, nil},
+		{LabelConflictRename, []*dto.LabelPair{
+			{Name: strPtr("exported_exported_job"), Value: strPtr("body")},
+			{Name: strPtr("exported_job"), Value: strPtr("old")},
+			{Name: strPtr("job"), Value: strPtr("path")},
+		}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			a := NewAggregate(SetLabelConflictPolicy(test.policy))
+			m := &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: strPtr("job"), Value: strPtr("body")},
+					{Name: strPtr("exported_job"), Value: strPtr("old")},
+				},
+			}
+
+			err := a.formatLabels(m, []labelPair{{"job", "path"}})
+			if test.err != nil {
+				assert.Equal(t, test.err, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, m.Label)
+		})
+	}
+}
+
+func TestParseLabelConflictPolicy(t *testing.T) {
+	policy, err := ParseLabelConflictPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, LabelConflictReject, policy)
+
+	policy, err = ParseLabelConflictPolicy("rename")
+	assert.NoError(t, err)
+	assert.Equal(t, LabelConflictRename, policy)
+
+	_, err = ParseLabelConflictPolicy("merge")
+	assert.EqualError(t, err, `unknown label conflict policy "merge"`)
+}
+
 var testLabelTable = []struct {
 	inputName     string
 	m             *dto.Metric
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ErrPushLimitExceeded is wrapped by every error caused by a push that is
+// larger than the configured PushLimits
+var ErrPushLimitExceeded = errors.New("push limit exceeded")
+
+// PushLimits bounds the size of a single push. A zero value disables the
+// matching limit.
+type PushLimits struct {
+	MaxBodyBytes int64
+	// MaxDecompressedBytes bounds compressed bodies once decompressed. It
+	// can't be disabled and defaults to 64MiB.
+	MaxDecompressedBytes int64
+	MaxFamilies          int
+	MaxSeries            int
+	MaxLabels            int
+	MaxLabelValueLength  int
+}
+
+func SetPushLimits(limits PushLimits) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.pushLimits = limits
+	}
+}
+
+func limitError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrPushLimitExceeded, fmt.Sprintf(format, args...))
+}
+
+// check validates parsed families against the limits. Labels from the
+// path count towards the label limits of every series.
+func (pl PushLimits) check(families map[string]*dto.MetricFamily, labels []labelPair) error {
+	if pl.MaxFamilies > 0 && len(families) > pl.MaxFamilies {
+		return limitError("%d metric families in push, the limit is %d", len(families), pl.MaxFamilies)
+	}
+
+	if pl.MaxLabelValueLength > 0 {
+		for _, l := range labels {
+			if len(l.value) > pl.MaxLabelValueLength {
+				return limitError("value of path label %s is %d bytes long, the limit is %d", l.name, len(l.value), pl.MaxLabelValueLength)
+			}
+		}
+	}
+
+	series := 0
+	for name, family := range families {
+		series += len(family.Metric)
+		if pl.MaxSeries > 0 && series > pl.MaxSeries {
+			return limitError("more than %d series in push", pl.MaxSeries)
+		}
+
+		for _, m := range family.Metric {
+			if count := len(m.Label) + len(labels); pl.MaxLabels > 0 && count > pl.MaxLabels {
+				return limitError("series of metric %s has %d labels, the limit is %d", name, count, pl.MaxLabels)
+			}
+			if pl.MaxLabelValueLength == 0 {
+				continue
+			}
+			for _, l := range m.Label {
+				if len(l.GetValue()) > pl.MaxLabelValueLength {
+					return limitError("value of label %s on metric %s is %d bytes long, the limit is %d",
+						l.GetName(), name, len(l.GetValue()), pl.MaxLabelValueLength)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushLimitsCheck(t *testing.T) {
+	const input = `# TYPE counter counter
+counter{a="a",b="bb"} 1
+counter{a="a",b="b"} 1
+# TYPE gauge gauge
+gauge 1
+`
+
+	tests := []struct {
+		name   string
+		limits PushLimits
+		labels []labelPair
+		err    string
+	}{
+		{"no limits", PushLimits{}, testLabels, ""},
+		{"at every limit", PushLimits{MaxFamilies: 2, MaxSeries: 3, MaxLabels: 3, MaxLabelValueLength: 4}, testLabels, ""},
+		{"families", PushLimits{MaxFamilies: 1}, testLabels, "push limit exceeded: 2 metric families in push, the limit is 1"},
+		{"series", PushLimits{MaxSeries: 1}, testLabels, "push limit exceeded: more than 1 series in push"},
+		{"labels", PushLimits{MaxLabels: 2}, testLabels, "push limit exceeded: series of metric counter has 3 labels, the limit is 2"},
+		{"body label value", PushLimits{MaxLabelValueLength: 1}, nil, "push limit exceeded: value of label b on metric counter is 2 bytes long, the limit is 1"},
+		{"path label value", PushLimits{MaxLabelValueLength: 3}, testLabels, "push limit exceeded: value of path label job is 4 bytes long, the limit is 3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			families, err := parseFamilies(strings.NewReader(input))
+			require.NoError(t, err)
+
+			err = test.limits.check(families, test.labels)
+			if test.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equal(t, test.err, err.Error())
+				assert.True(t, errors.Is(err, ErrPushLimitExceeded))
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Approximate sizes of what a stored series and family hold on to, close
+// enough to budget memory by without walking the heap
+const (
+	seriesOverhead  = 160
+	labelOverhead   = 64
+	bucketOverhead  = 48
+	familyOverhead  = 512
+	evictedFraction = 0.9
+)
+
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// seriesSize approximates the memory used by a stored series
+func seriesSize(m *dto.Metric) int64 {
+	size := int64(seriesOverhead)
+	for _, l := range m.Label {
+		size += labelOverhead + int64(len(l.GetName())+len(l.GetValue()))
+	}
+	if h := m.GetHistogram(); h != nil {
+		size += bucketOverhead * int64(len(h.Bucket))
+	}
+	if s := m.GetSummary(); s != nil {
+		size += bucketOverhead * int64(len(s.Quantile))
+	}
+	return size
+}
+
+// memoryBudget tracks the approximate memory used by stored series. Above
+// the soft limit new series are rejected, while existing ones are still
+// updated, and above the hard limit the least recently updated series are
+// evicted. A limit of zero disables it.
+type memoryBudget struct {
+	soft, hard int64
+	used       atomic.Int64
+	evicting   sync.Mutex
+}
+
+// SetMemoryBudget sets the approximate number of bytes stored series may use
+// before new series are rejected, and before the least recently updated
+// series are evicted
+func SetMemoryBudget(soft, hard int64) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.memory.soft, a.memory.hard = soft, hard
+		MemoryLimitBytes.WithLabelValues("soft").Set(float64(soft))
+		MemoryLimitBytes.WithLabelValues("hard").Set(float64(hard))
+	}
+}
+
+func (b *memoryBudget) add(delta int64) {
+	b.used.Add(delta)
+	MemoryUsageBytes.Add(float64(delta))
+}
+
+func (b *memoryBudget) overSoftLimit() bool {
+	return b.soft > 0 && b.used.Load() >= b.soft
+}
+
+func (b *memoryBudget) overHardLimit() bool {
+	return b.hard > 0 && b.used.Load() > b.hard
+}
+
+// evictionTarget is the usage eviction brings memory back down to, so the
+// hard limit isn't hit again by the next push
+func (b *memoryBudget) evictionTarget() int64 {
+	if b.soft > 0 && b.soft < b.hard {
+		return b.soft
+	}
+	return int64(float64(b.hard) * evictedFraction)
+}
+
+func (b *memoryBudget) softLimitError() error {
+	return categorize(categoryLimit, fmt.Errorf("%w: the soft limit of %d bytes is reached, so new series are rejected", ErrMemoryBudgetExceeded, b.soft))
+}
+
+// seriesTracker is told about every series stored or removed, to keep the
+// shared label strings and the memory budget up to date. A nil tracker
+// tracks nothing.
+type seriesTracker struct {
+	interned *internTable
+	memory   *memoryBudget
+	now      func() time.Time
+}
+
+func (t *seriesTracker) addBytes(delta int64) {
+	if t != nil && t.memory != nil {
+		t.memory.add(delta)
+	}
+}
+
+// timestamp returns when a series stored now was last updated
+func (t *seriesTracker) timestamp() int64 {
+	if t == nil || t.now == nil {
+		return 0
+	}
+	return t.now().UnixNano()
+}
+
+// MemoryUsage reports the approximate memory used by stored series
+type MemoryUsage struct {
+	UsedBytes      int64  `json:"usedBytes"`
+	SoftLimitBytes int64  `json:"softLimitBytes"`
+	HardLimitBytes int64  `json:"hardLimitBytes"`
+	State          string `json:"state"`
+}
+
+func (a *Aggregate) Memory() MemoryUsage {
+	usage := MemoryUsage{
+		UsedBytes:      a.memory.used.Load(),
+		SoftLimitBytes: a.memory.soft,
+		HardLimitBytes: a.memory.hard,
+		State:          "ok",
+	}
+	switch {
+	case a.memory.overHardLimit():
+		usage.State = "hard_limit"
+	case a.memory.overSoftLimit():
+		usage.State = "soft_limit"
+	}
+	return usage
+}
+
+// newSeriesCount returns how many series of family would be new to the
+// stored family, every one of them if nothing is stored
+func newSeriesCount(stored *metricFamily, family *dto.MetricFamily) int {
+	if stored == nil {
+		return len(family.Metric)
+	}
+	stored.lock.RLock()
+	defer stored.lock.RUnlock()
+	count := 0
+	for _, m := range family.Metric {
+		if _, ok := stored.series.get(fingerprintLabels(m.Label), m.Label); !ok {
+			count++
+		}
+	}
+	return count
+}
+
+type evictableSeries struct {
+	name   string
+	family *metricFamily
+	seriesEntry
+}
+
+// enforceMemoryBudget evicts the least recently updated series once the
+// hard limit is exceeded, until usage is back under the eviction target.
+// Every shard is locked while evicting, so pushes wait for it to finish.
+func (a *Aggregate) enforceMemoryBudget() {
+	if !a.memory.overHardLimit() || !a.memory.evicting.TryLock() {
+		return
+	}
+	defer a.memory.evicting.Unlock()
+
+	all := a.families.all()
+	a.families.lock(all)
+	defer a.families.unlock(all)
+
+	var series []evictableSeries
+	a.families.rangeLocked(all, func(name string, family *metricFamily) {
+		family.lock.RLock()
+		family.series.eachEntry(func(e seriesEntry) {
+			series = append(series, evictableSeries{name, family, e})
+		})
+		family.lock.RUnlock()
+	})
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].updated < series[j].updated
+	})
+
+	target := a.memory.evictionTarget()
+	touched := map[string]int{}
+	evicted := 0
+	for _, s := range series {
+		if a.memory.used.Load() <= target {
+			break
+		}
+		s.family.lock.Lock()
+		s.family.version++
+		s.family.series.delete(fingerprintLabels(s.metric.Label), s.metric.Label)
+		remaining := s.family.len()
+		s.family.lock.Unlock()
+		evicted++
+
+		// emptied families are removed straight away, so their overhead
+		// counts towards the target too
+		if remaining == 0 {
+			a.families.remove(s.name)
+			MetricCountByFamily.DeleteLabelValues(s.name)
+			delete(touched, s.name)
+			continue
+		}
+		touched[s.name] = remaining
+	}
+
+	for name, remaining := range touched {
+		MetricCountByFamily.WithLabelValues(name).Set(float64(remaining))
+	}
+
+	SeriesEvicted.Add(float64(evicted))
+	TotalFamiliesGauge.Set(float64(a.families.len()))
+	log.Printf("memory hard limit of %d bytes exceeded, evicted %d series", a.memory.hard, evicted)
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesSize(t *testing.T) {
+	counter := counterSeries(1, "code", "200")
+	assert.Equal(t, int64(seriesOverhead+labelOverhead+len("code200")), seriesSize(counter))
+
+	a := NewAggregate()
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 1\n"), nil))
+	assert.Equal(t, familyOverhead+seriesSize(counter), a.Memory().UsedBytes)
+
+	// updating a series doesn't change its size, and deleting it frees it
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 1\n"), nil))
+	assert.Equal(t, familyOverhead+seriesSize(counter), a.Memory().UsedBytes)
+	a.deleteFamily("requests", nil)
+	assert.Equal(t, int64(0), a.Memory().UsedBytes)
+}
+
+func TestMemorySoftLimit(t *testing.T) {
+	a := NewAggregate()
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 1\n"), testLabels))
+	a.memory.soft = a.memory.used.Load()
+	assert.Equal(t, "soft_limit", a.Memory().State)
+
+	// stored series are still updated
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 2\n"), testLabels))
+
+	// but new series and families are rejected
+	err := a.parseAndMerge(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 1\nrequests{code=\"500\"} 1\n"), testLabels)
+	assert.ErrorIs(t, err, ErrMemoryBudgetExceeded)
+	assert.Equal(t, categoryLimit, categoryOf(err))
+	err = a.parseAndMerge(strings.NewReader("# TYPE errors counter\nerrors 1\n"), testLabels)
+	assert.ErrorIs(t, err, ErrMemoryBudgetExceeded)
+
+	families, err := parseFamilies(strings.NewReader("# TYPE requests counter\nrequests{code=\"200\"} 1\n# TYPE errors counter\nerrors 1\n"))
+	require.NoError(t, err)
+	result := a.pushFamilies(families, testLabels, true, false)
+	assert.Equal(t, []string{"requests"}, result.Accepted)
+	require.Len(t, result.Rejected, 1)
+	assert.Equal(t, "errors", result.Rejected[0].Family)
+
+	body := strings.Builder{}
+	a.encodeAllMetrics(&body, expfmt.FmtText)
+	assert.Equal(t, "# TYPE requests counter\nrequests{code=\"200\",job=\"test\"} 4\n", body.String())
+}
+
+func TestMemoryHardLimit(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewAggregate()
+	a.tracker.now = func() time.Time { return now }
+
+	push := func(body string) {
+		now = now.Add(time.Second)
+		require.NoError(t, a.parseAndMerge(strings.NewReader(body), testLabels))
+	}
+	push("# TYPE requests counter\nrequests{code=\"200\"} 1\n")
+	push("# TYPE errors counter\nerrors{code=\"500\"} 1\nerrors{code=\"503\"} 1\n")
+	push("# TYPE requests counter\nrequests{code=\"200\"} 1\n")
+	// only the first errors series is updated again
+	push("# TYPE errors counter\nerrors{code=\"500\"} 1\n")
+
+	// the least recently updated series is evicted first, until usage is
+	// back under 90% of the hard limit
+	a.memory.hard = a.memory.used.Load() - 1
+	a.enforceMemoryBudget()
+	assert.Equal(t, 2, a.Len())
+	body := strings.Builder{}
+	a.encodeAllMetrics(&body, expfmt.FmtText)
+	assert.Equal(t, "# TYPE errors counter\nerrors{code=\"500\",job=\"test\"} 2\n# TYPE requests counter\nrequests{code=\"200\",job=\"test\"} 2\n", body.String())
+	assert.Equal(t, "ok", a.Memory().State)
+
+	// and emptied families are removed
+	a.memory.hard = familyOverhead
+	a.enforceMemoryBudget()
+	assert.Equal(t, 0, a.Len())
+	assert.Equal(t, int64(0), a.Memory().UsedBytes)
+}
@@ -124,42 +124,37 @@ func mergeMetric(ty dto.MetricType, a, b *dto.Metric) *dto.Metric {
 	return nil
 }
 
-func (mf *metricFamily) mergeFamily(b *dto.MetricFamily) error {
+// checkType returns an error if b can't be merged into mf because their
+// types differ
+func (mf *metricFamily) checkType(b *dto.MetricFamily) error {
 	if *mf.Type != *b.Type {
 		return fmt.Errorf("cannot merge metric '%s': type %s != %s",
 			*mf.Name, mf.Type.String(), b.Type.String())
 	}
+	return nil
+}
 
-	newMetric := []*dto.Metric{}
+func (mf *metricFamily) mergeFamily(b *dto.MetricFamily) error {
+	if err := mf.checkType(b); err != nil {
+		return err
+	}
 
-	i, j := 0, 0
 	mf.lock.Lock()
 	defer mf.lock.Unlock()
-	for i < len(mf.Metric) && j < len(b.Metric) {
-		if labelsLessThan(mf.Metric[i].Label, b.Metric[j].Label) {
-			newMetric = append(newMetric, mf.Metric[i])
-			i++
-		} else if labelsLessThan(b.Metric[j].Label, mf.Metric[i].Label) {
-			newMetric = append(newMetric, b.Metric[j])
-			j++
+	mf.version++
+	for _, m := range b.Metric {
+		fp := fingerprintLabels(m.Label)
+		existing, ok := mf.series.get(fp, m.Label)
+		if !ok {
+			mf.series.set(fp, m)
+			continue
+		}
+		if merged := mergeMetric(*mf.Type, existing, m); merged != nil {
+			mf.series.set(fp, merged)
 		} else {
-			merged := mergeMetric(*mf.Type, mf.Metric[i], b.Metric[j])
-			if merged != nil {
-				newMetric = append(newMetric, merged)
-			}
-			i++
-			j++
+			mf.series.delete(fp, m.Label)
 		}
 	}
-
-	for ; i < len(mf.Metric); i++ {
-		newMetric = append(newMetric, mf.Metric[i])
-	}
-	for ; j < len(b.Metric); j++ {
-		newMetric = append(newMetric, b.Metric[j])
-	}
-
-	mf.Metric = newMetric
 	return nil
 }
 
@@ -174,12 +169,17 @@ func validateFamily(f *dto.MetricFamily) error {
 		}
 		lSet[model.MetricNameLabel] = model.LabelValue(f.GetName())
 		if err := lSet.Validate(); err != nil {
-			return err
+			for name := range lSet {
+				if !name.IsValid() {
+					return categorize(categoryInvalidName, err)
+				}
+			}
+			return categorize(categoryInvalidValue, err)
 		}
 
 		fingerprint := lSet.Fingerprint()
 		if _, found := fingerprints[fingerprint]; found {
-			return fmt.Errorf("duplicate labels: %v", lSet)
+			return categorize(categoryDuplicateLabels, fmt.Errorf("duplicate labels: %v", lSet))
 		}
 		fingerprints[fingerprint] = struct{}{}
 	}
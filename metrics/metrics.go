@@ -11,6 +11,20 @@ func init() {
 		TotalFamiliesGauge,
 		MetricCountByFamily,
 		MetricPushes,
+		RateLimitedPushes,
+		RateLimitClients,
+		TypeConflictsTotal,
+		DeduplicatedPushes,
+		IdempotencyKeys,
+		IngestQueueDepth,
+		IngestQueueLatency,
+		IngestQueueFull,
+		IngestRejectedFamilies,
+		InternedStrings,
+		MemoryUsageBytes,
+		MemoryLimitBytes,
+		MemoryRejectedSeries,
+		SeriesEvicted,
 	)
 }
 
@@ -54,3 +68,125 @@ var MetricPushes = prometheus.NewCounterVec(
 		"push_job",
 	},
 )
+
+var RateLimitedPushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rate_limited_pushes",
+		Help:      "Total number of push requests rejected by rate limiting, per limit applied",
+	},
+	[]string{
+		"limit",
+	},
+)
+
+var RateLimitClients = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rate_limit_clients",
+		Help:      "Number of clients currently tracked by the push rate limiter",
+	},
+)
+
+var TypeConflictsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "type_conflicts",
+		Help:      "Total number of families pushed with a different type than the one stored, per resolution",
+	},
+	[]string{
+		"resolution",
+	},
+)
+
+var DeduplicatedPushes = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "deduplicated_pushes",
+		Help:      "Total number of retried pushes answered from the idempotency key cache without being merged",
+	},
+)
+
+var IdempotencyKeys = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "idempotency_keys",
+		Help:      "Number of idempotency keys currently remembered",
+	},
+)
+
+var IngestQueueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_queue_depth",
+		Help:      "Number of pushes waiting in the ingest queue to be merged",
+	},
+)
+
+var IngestQueueLatency = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_queue_latency_seconds",
+		Help:      "Time from a push being queued until it was merged",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 9),
+	},
+)
+
+var IngestQueueFull = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_queue_full",
+		Help:      "Total number of pushes turned away because the ingest queue was full",
+	},
+)
+
+var IngestRejectedFamilies = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_rejected_families",
+		Help:      "Total number of queued families that couldn't be merged, such as for type conflicts",
+	},
+)
+
+var InternedStrings = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "interned_strings",
+		Help:      "Number of distinct label names and values shared by stored series",
+	},
+)
+
+var MemoryUsageBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "memory_usage_bytes",
+		Help:      "Approximate number of bytes used by stored series",
+	},
+)
+
+var MemoryLimitBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "memory_limit_bytes",
+		Help:      "Memory budget for stored series, per limit, where 0 is unlimited",
+	},
+	[]string{
+		"limit",
+	},
+)
+
+var MemoryRejectedSeries = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "memory_rejected_series",
+		Help:      "Total number of new series rejected because the memory soft limit was reached",
+	},
+)
+
+var SeriesEvicted = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "series_evicted",
+		Help:      "Total number of least recently updated series evicted because the memory hard limit was exceeded",
+	},
+)
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PushPolicyKey is the gin context key that authentication middleware uses
+// to restrict what a request may push or read
+const PushPolicyKey = "pushPolicy"
+
+// PushLabelsKey is the gin context key that authentication middleware uses
+// to add labels to every metric in a push. They take precedence over labels
+// from the path as they come from verified credentials.
+const PushLabelsKey = "pushLabels"
+
+// PushPolicy restricts the jobs and metric families a request may touch
+type PushPolicy interface {
+	AllowJob(job string) bool
+	AllowFamily(name string) bool
+}
+
+func pushPolicyFromContext(c *gin.Context) PushPolicy {
+	if v, ok := c.Get(PushPolicyKey); ok {
+		if policy, ok := v.(PushPolicy); ok {
+			return policy
+		}
+	}
+	return nil
+}
+
+func contextLabels(c *gin.Context) map[string]string {
+	v, ok := c.Get(PushLabelsKey)
+	if !ok {
+		return nil
+	}
+	labels, _ := v.(map[string]string)
+	return labels
+}
+
+// withContextLabels adds the labels from PushLabelsKey to those parsed from
+// the path, replacing any path label of the same name
+func withContextLabels(c *gin.Context, labels []labelPair) []labelPair {
+	contextLabels := contextLabels(c)
+	if len(contextLabels) == 0 {
+		return labels
+	}
+
+	merged := make([]labelPair, 0, len(labels)+len(contextLabels))
+	for _, l := range labels {
+		if _, replaced := contextLabels[l.name]; !replaced {
+			merged = append(merged, l)
+		}
+	}
+
+	names := make([]string, 0, len(contextLabels))
+	for name := range contextLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		merged = append(merged, labelPair{name, contextLabels[name]})
+	}
+	return merged
+}
+
+// dropContextLabels removes the labels from PushLabelsKey from every pushed
+// series, so the verified values replace them even when labels on series
+// otherwise win conflicts
+func dropContextLabels(c *gin.Context, families map[string]*dto.MetricFamily) {
+	contextLabels := contextLabels(c)
+	if len(contextLabels) == 0 {
+		return
+	}
+
+	for _, family := range families {
+		for _, m := range family.Metric {
+			kept := m.Label[:0]
+			for _, l := range m.Label {
+				if _, verified := contextLabels[l.GetName()]; !verified {
+					kept = append(kept, l)
+				}
+			}
+			m.Label = kept
+		}
+	}
+}
+
+// checkFamiliesAllowed returns the name of the first family the policy
+// rejects, or an empty string if every family is allowed
+func checkFamiliesAllowed(policy PushPolicy, families map[string]*dto.MetricFamily) string {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !policy.AllowFamily(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkJobsAllowed returns the family and job of the first pushed series the
+// policy doesn't allow to be stored under its job. The job is the one a
+// series ends up with once the push labels are added, which may come from
+// the body rather than the path, depending on the label conflict policy.
+func (a *Aggregate) checkJobsAllowed(policy PushPolicy, families map[string]*dto.MetricFamily, labels []labelPair) (string, string) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, m := range families[name].Metric {
+			// the labels are added to a copy, as the push is prepared later
+			stored := &dto.Metric{Label: make([]*dto.LabelPair, len(m.Label))}
+			for i, l := range m.Label {
+				stored.Label[i] = &dto.LabelPair{Name: l.Name, Value: l.Value}
+			}
+			if err := a.formatLabels(stored, labels); err != nil {
+				// the push is rejected for it when prepared
+				continue
+			}
+			if job := labelValue(stored, "job"); !policy.AllowJob(job) {
+				return name, job
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pushResult reports which families of a push were applied
+type pushResult struct {
+	Accepted []string    `json:"accepted"`
+	Rejected []pushError `json:"rejected"`
+
+	// conflicts are the type conflicts of the push, to record once it is
+	// known which of them were applied
+	conflicts []resolvedConflict
+}
+
+func (r *pushResult) reject(name string, err error) {
+	r.Rejected = append(r.Rejected, newPushError(name, err))
+}
+
+// mergeFamilies applies all of the families, or none of them if any is
+// invalid
+func (a *Aggregate) mergeFamilies(inFamilies map[string]*dto.MetricFamily, labels []labelPair) error {
+	result := a.pushFamilies(inFamilies, labels, false, false)
+	if len(result.Rejected) > 0 {
+		return result.Rejected[0].err
+	}
+	return nil
+}
+
+// pushFamilies validates every family before merging any of them. Unless
+// partial is set, a single invalid family rejects the whole push and
+// nothing is merged. With replace set, every stored series carrying the
+// labels is removed before the push is merged, like a pushgateway PUT, from
+// the families the filters allow.
+func (a *Aggregate) pushFamilies(inFamilies map[string]*dto.MetricFamily, labels []labelPair, partial, replace bool, filters ...familyFilter) pushResult {
+	result := pushResult{Accepted: []string{}, Rejected: []pushError{}}
+	valid := a.prepareFamilies(inFamilies, labels, &result)
+	a.storeFamilies(inFamilies, valid, labels, partial, replace, &result, filters...)
+	a.conflicts.record(result.conflicts...)
+	return result
+}
+
+// prepareFamilies prepares every family of a push, rejecting the invalid
+// ones, and returns the names of the valid ones in order
+func (a *Aggregate) prepareFamilies(inFamilies map[string]*dto.MetricFamily, labels []labelPair, result *pushResult) []string {
+	names := make([]string, 0, len(inFamilies))
+	for name := range inFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	valid := make([]string, 0, len(names))
+	for _, name := range names {
+		if err := a.prepareFamily(inFamilies[name], labels); err != nil {
+			result.reject(name, err)
+			continue
+		}
+		valid = append(valid, name)
+	}
+	return valid
+}
+
+// storeFamilies merges the valid families of a push into the aggregate.
+// Unless partial is set, nothing is merged once any family is rejected. The
+// type conflicts of the rejected and merged families are added to the
+// result, for the caller to record.
+func (a *Aggregate) storeFamilies(inFamilies map[string]*dto.MetricFamily, valid []string, labels []labelPair, partial, replace bool, result *pushResult, filters ...familyFilter) {
+	// only the shards of the families the push may touch are locked, unless
+	// it replaces series, which may be in any family
+	var locked shardSet
+	if replace {
+		locked = a.families.all()
+	} else {
+		touched := make([]string, 0, 2*len(valid))
+		for _, name := range valid {
+			touched = append(touched, name)
+			if a.options.typeConflictPolicy == TypeConflictKeepBoth {
+				touched = append(touched, keepBothName(inFamilies[name]))
+			}
+		}
+		locked = a.families.shardsOf(touched...)
+	}
+	a.families.lock(locked)
+
+	var (
+		matchers  []labelPair
+		remaining map[string]int
+	)
+	if replace {
+		matchers = a.seriesMatchers(labels)
+		remaining = a.remainingSeries(matchers, filters...)
+	}
+
+	// types are checked with the lock held, so a concurrent push can't
+	// create a conflicting family between the check and the merge. They are
+	// checked even once the push is rejected, so every problem is reported.
+	type target struct {
+		pushed, stored string
+		replace        bool
+		conflict       *resolvedConflict
+	}
+	targets := make([]target, 0, len(valid))
+	overSoftLimit := a.memory.overSoftLimit()
+	for _, name := range valid {
+		t := target{pushed: name, stored: name}
+		existing, ok := a.families.lookup(name)
+		if kept, replaced := remaining[name]; replaced && kept == 0 {
+			// the whole stored family is being replaced, so its type doesn't
+			// matter
+			ok = false
+		}
+		if ok {
+			if err := existing.checkType(inFamilies[name]); err != nil {
+				stored, replaceStored, resolved, err := a.resolveTypeConflict(existing, inFamilies[name], err)
+				if err != nil {
+					result.conflicts = append(result.conflicts, resolved)
+					result.reject(name, categorize(categoryTypeConflict, err))
+					continue
+				}
+				t.stored, t.replace, t.conflict = stored, replaceStored, &resolved
+			}
+		}
+		if overSoftLimit {
+			// past the soft limit the stored series are still updated, but
+			// families adding series are turned away
+			stored, _ := a.families.lookup(t.stored)
+			if t.replace {
+				stored = nil
+			}
+			if added := newSeriesCount(stored, inFamilies[name]); added > 0 {
+				MemoryRejectedSeries.Add(float64(added))
+				result.reject(name, a.memory.softLimitError())
+				continue
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	if len(result.Rejected) > 0 && !partial {
+		a.families.unlock(locked)
+		sortRejections(result.Rejected)
+		return
+	}
+
+	for name, kept := range remaining {
+		if kept == 0 {
+			a.families.remove(name)
+			MetricCountByFamily.DeleteLabelValues(name)
+			continue
+		}
+		family, _ := a.families.lookup(name)
+		family.lock.Lock()
+		family.removeSeries(matchers)
+		family.lock.Unlock()
+		MetricCountByFamily.WithLabelValues(name).Set(float64(kept))
+	}
+
+	for _, t := range targets {
+		existing, ok := a.families.lookup(t.stored)
+		if ok && !t.replace {
+			if err := existing.mergeFamily(inFamilies[t.pushed]); err != nil {
+				result.reject(t.pushed, err)
+				continue
+			}
+		} else {
+			existing = newMetricFamily(inFamilies[t.pushed], a.tracker)
+			a.families.store(t.stored, existing)
+		}
+		result.Accepted = append(result.Accepted, t.pushed)
+		if t.conflict != nil {
+			result.conflicts = append(result.conflicts, *t.conflict)
+		}
+
+		existing.lock.RLock()
+		series := existing.len()
+		existing.lock.RUnlock()
+		MetricCountByFamily.WithLabelValues(t.stored).Set(float64(series))
+	}
+
+	a.families.unlock(locked)
+
+	TotalFamiliesGauge.Set(float64(a.families.len()))
+	sortRejections(result.Rejected)
+	a.enforceMemoryBudget()
+}
+
+// prepareFamily adds the push labels to every series and validates the
+// family, leaving it ready to merge
+func (a *Aggregate) prepareFamily(family *dto.MetricFamily, labels []labelPair) error {
+	// Sort labels in case source sends them inconsistently
+	for _, m := range family.Metric {
+		if err := a.formatLabels(m, labels); err != nil {
+			return categorize(categoryDuplicateLabels, err)
+		}
+	}
+
+	if err := validateFamily(family); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// remainingSeries returns how many series each stored family keeps once
+// those carrying the matchers are removed, for the families that have any
+// to remove. Only the families the filters allow are replaced. Every shard
+// must be locked.
+func (a *Aggregate) remainingSeries(matchers []labelPair, filters ...familyFilter) map[string]int {
+	remaining := map[string]int{}
+	if len(matchers) == 0 {
+		return remaining
+	}
+
+	a.families.rangeLocked(a.families.all(), func(name string, family *metricFamily) {
+		if !includeFamily(name, filters) {
+			return
+		}
+		family.lock.RLock()
+		if matched := family.countSeries(matchers); matched > 0 {
+			remaining[name] = family.len() - matched
+		}
+		family.lock.RUnlock()
+	})
+	return remaining
+}
+
+func sortRejections(rejected []pushError) {
+	sort.Slice(rejected, func(i, j int) bool {
+		return rejected[i].Family < rejected[j].Family
+	})
+}
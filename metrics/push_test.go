@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	pushStored = `# TYPE a counter
+a 1
+# TYPE c counter
+c 1
+`
+	// b is new and valid, c conflicts with the stored type and d has
+	// duplicate series
+	pushMixed = `# TYPE a counter
+a 1
+# TYPE b counter
+b 1
+# TYPE c gauge
+c 1
+# TYPE d counter
+d{x="1"} 1
+d{x="1"} 1
+`
+)
+
+func renderText(a *Aggregate) string {
+	buf := new(bytes.Buffer)
+	a.encodeAllMetrics(buf, expfmt.FmtText)
+	return buf.String()
+}
+
+func TestPushFamiliesAtomic(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(pushStored), nil))
+
+	families, err := parseFamilies(strings.NewReader(pushMixed))
+	require.NoError(t, err)
+
+	result := agg.pushFamilies(families, nil, false, false)
+	assert.Empty(t, result.Accepted)
+	// every problem is reported, even though the push was rejected already
+	require.Len(t, result.Rejected, 2)
+	assert.Equal(t, "c", result.Rejected[0].Family)
+	assert.Equal(t, categoryTypeConflict, result.Rejected[0].Category)
+	assert.Equal(t, "d", result.Rejected[1].Family)
+	assert.Equal(t, categoryDuplicateLabels, result.Rejected[1].Category)
+
+	// nothing from the push was applied
+	assert.Equal(t, "# TYPE a counter\na 1\n# TYPE c counter\nc 1\n", renderText(agg))
+}
+
+func TestPushFamiliesAtomicTypeConflict(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(pushStored), nil))
+
+	err := agg.parseAndMerge(strings.NewReader("# TYPE a counter\na 1\n# TYPE b counter\nb 1\n# TYPE c gauge\nc 1\n"), nil)
+	assert.EqualError(t, err, "cannot merge metric 'c': type COUNTER != GAUGE")
+
+	assert.Equal(t, "# TYPE a counter\na 1\n# TYPE c counter\nc 1\n", renderText(agg))
+}
+
+func TestPushFamiliesPartial(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(pushStored), nil))
+
+	families, err := parseFamilies(strings.NewReader(pushMixed))
+	require.NoError(t, err)
+
+	result := agg.pushFamilies(families, nil, true, false)
+	assert.Equal(t, []string{"a", "b"}, result.Accepted)
+	require.Len(t, result.Rejected, 2)
+	assert.Equal(t, "c", result.Rejected[0].Family)
+	assert.Equal(t, "cannot merge metric 'c': type COUNTER != GAUGE", result.Rejected[0].Error)
+	assert.Equal(t, "d", result.Rejected[1].Family)
+	assert.Equal(t, `duplicate labels: {__name__="d", x="1"}`, result.Rejected[1].Error)
+
+	assert.Equal(t, "# TYPE a counter\na 2\n# TYPE b counter\nb 1\n# TYPE c counter\nc 1\n", renderText(agg))
+}
+
+func TestPushFamiliesReplace(t *testing.T) {
+	const stored = `# TYPE a counter
+a{job="x",instance="1"} 1
+a{job="x",instance="2"} 1
+a{job="y"} 1
+# TYPE b gauge
+b{job="x"} 1
+# TYPE c counter
+c{job="y"} 1
+`
+
+	tests := []struct {
+		name     string
+		push     string
+		rejected int
+		expected string
+	}{
+		{
+			"replaces the group",
+			"# TYPE a counter\na{instance=\"1\"} 5\n",
+			0,
+			"# TYPE a counter\na{instance=\"1\",job=\"x\"} 5\na{job=\"y\"} 1\n# TYPE c counter\nc{job=\"y\"} 1\n",
+		},
+		{
+			"family only held by the group can change type",
+			"# TYPE b counter\nb 5\n",
+			0,
+			"# TYPE a counter\na{job=\"y\"} 1\n# TYPE b counter\nb{job=\"x\"} 5\n# TYPE c counter\nc{job=\"y\"} 1\n",
+		},
+		{
+			"type conflict with another group",
+			"# TYPE c gauge\nc 5\n",
+			1,
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agg := NewAggregate()
+			require.NoError(t, agg.parseAndMerge(strings.NewReader(stored), nil))
+			// nothing changes when the push is rejected
+			expected := renderText(agg)
+			if test.expected != "" {
+				expected = test.expected
+			}
+
+			families, err := parseFamilies(strings.NewReader(test.push))
+			require.NoError(t, err)
+
+			result := agg.pushFamilies(families, []labelPair{{"job", "x"}}, false, true)
+			assert.Len(t, result.Rejected, test.rejected)
+			assert.Equal(t, expected, renderText(agg))
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// renderCache keeps the latest encoding of a family in each format it was
+// scraped in
+type renderCache struct {
+	lock      sync.Mutex
+	encodings map[expfmt.Format]cachedEncoding
+}
+
+type cachedEncoding struct {
+	version uint64
+	data    []byte
+}
+
+func (rc *renderCache) get(format expfmt.Format, version uint64) ([]byte, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	cached, ok := rc.encodings[format]
+	if !ok || cached.version != version {
+		return nil, false
+	}
+	return cached.data, true
+}
+
+func (rc *renderCache) set(format expfmt.Format, version uint64, data []byte) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.encodings == nil {
+		rc.encodings = map[expfmt.Format]cachedEncoding{}
+	}
+	// a slower concurrent render of an older version mustn't replace a
+	// newer one
+	if cached, ok := rc.encodings[format]; ok && cached.version > version {
+		return
+	}
+	rc.encodings[format] = cachedEncoding{version: version, data: data}
+}
+
+// encoded returns the family encoded in format, only encoding it again if
+// it changed since it was last encoded in that format. A family emptied
+// since it was listed for a scrape, by a delete or eviction, encodes to
+// nothing.
+func (mf *metricFamily) encoded(format expfmt.Format) ([]byte, error) {
+	// stored series are replaced rather than changed when merged, so the
+	// family only needs to be locked while its series are listed
+	mf.lock.RLock()
+	version := mf.version
+	if data, ok := mf.render.get(format, version); ok {
+		mf.lock.RUnlock()
+		return data, nil
+	}
+	out := mf.snapshot()
+	mf.lock.RUnlock()
+	if len(out.Metric) == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := expfmt.NewEncoder(&buf, format).Encode(out); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	mf.render.set(format, version, data)
+	return data, nil
+}
+
+// encodeTo writes the family encoded in format to writer
+func (mf *metricFamily) encodeTo(writer io.Writer, format expfmt.Format) error {
+	data, err := mf.encoded(format)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// encodeSeriesTo writes the series of the family accepted by include,
+// encoded in format, to writer. Only whole families are cached, so the
+// series are encoded every time.
+func (mf *metricFamily) encodeSeriesTo(writer io.Writer, format expfmt.Format, include func(m *dto.Metric) bool) error {
+	mf.lock.RLock()
+	out := mf.snapshot()
+	mf.lock.RUnlock()
+
+	series := out.Metric[:0]
+	for _, m := range out.Metric {
+		if include(m) {
+			series = append(series, m)
+		}
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	out.Metric = series
+	return expfmt.NewEncoder(writer, format).Encode(out)
+}
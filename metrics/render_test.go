@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCache(t *testing.T) {
+	mf := newMetricFamily(counterFamily("requests", counterSeries(1, "code", "200")), nil)
+
+	text, err := mf.encoded(expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE requests counter\nrequests{code=\"200\"} 1\n", string(text))
+
+	// an unchanged family is served from the cache
+	cached, err := mf.encoded(expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Same(t, &text[0], &cached[0])
+
+	// each format is cached separately
+	proto, err := mf.encoded(expfmt.FmtProtoDelim)
+	require.NoError(t, err)
+	assert.NotEqual(t, text, proto)
+
+	// and a change is rendered again
+	require.NoError(t, mf.mergeFamily(counterFamily("requests", counterSeries(2, "code", "200"), counterSeries(1, "code", "500"))))
+	text, err = mf.encoded(expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE requests counter\nrequests{code=\"200\"} 3\nrequests{code=\"500\"} 1\n", string(text))
+
+	mf.lock.Lock()
+	mf.removeSeries([]labelPair{{"code", "200"}})
+	mf.lock.Unlock()
+	text, err = mf.encoded(expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE requests counter\nrequests{code=\"500\"} 1\n", string(text))
+
+	// an older render finishing late doesn't replace a newer one
+	mf.render.set(expfmt.FmtText, 0, []byte("stale"))
+	text, err = mf.encoded(expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE requests counter\nrequests{code=\"500\"} 1\n", string(text))
+}
+
+// BenchmarkRender scrapes a gateway of 1000 families of 100 series, with
+// none, one or all of them changed since the last scrape
+func TestRenderEmptiedFamily(t *testing.T) {
+	a := NewAggregate()
+	require.NoError(t, a.parseAndMerge(strings.NewReader("# TYPE a counter\na 1\n# TYPE b counter\nb 1\n# TYPE c counter\nc 1\n"), nil))
+
+	// b is emptied as if by a delete between a scrape listing the families
+	// and encoding them, so it is skipped without ending the scrape
+	set := a.families.shardsOf("b")
+	a.families.lock(set)
+	b, _ := a.families.lookup("b")
+	a.families.unlock(set)
+	b.lock.Lock()
+	b.removeSeriesWhere(func(*dto.Metric) bool { return true })
+	b.lock.Unlock()
+
+	assert.Equal(t, "# TYPE a counter\na 1\n# TYPE c counter\nc 1\n", renderText(a))
+}
+
+func BenchmarkRender(b *testing.B) {
+	a := NewAggregate()
+	var body strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&body, "# TYPE family_%d counter\n", i)
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&body, "family_%d{instance=\"%d\"} 1\n", i, j)
+		}
+	}
+	if err := a.parseAndMerge(strings.NewReader(body.String()), testLabels); err != nil {
+		b.Fatalf("unexpected error %s", err)
+	}
+	a.encodeAllMetrics(io.Discard, expfmt.FmtText)
+
+	push := func(i int) {
+		body := fmt.Sprintf("# TYPE family_%d counter\nfamily_%d{instance=\"0\"} 1\n", i, i)
+		if err := a.parseAndMerge(strings.NewReader(body), testLabels); err != nil {
+			b.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	b.Run("idle", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			a.encodeAllMetrics(io.Discard, expfmt.FmtText)
+		}
+	})
+	b.Run("one_changed", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			push(n % 1000)
+			a.encodeAllMetrics(io.Discard, expfmt.FmtText)
+		}
+	})
+	b.Run("all_changed", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			for i := 0; i < 1000; i++ {
+				push(i)
+			}
+			b.StartTimer()
+			a.encodeAllMetrics(io.Discard, expfmt.FmtText)
+		}
+	})
+}
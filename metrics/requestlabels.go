@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+)
+
+// requestLabels are the labels clients may set from query parameters and
+// headers, for clients that can't easily build grouping keys into the path
+type requestLabels struct {
+	// query is the set of label names allowed as query parameters
+	query map[string]struct{}
+	// headers maps canonical header names to the label they set
+	headers map[string]string
+}
+
+// SetRequestLabels allows the named labels to be set by query parameters,
+// and the headers to set the labels they are mapped to
+func SetRequestLabels(queryLabels []string, headerLabels map[string]string) aggregateOptionsFunc {
+	return func(a *Aggregate) {
+		a.options.requestLabels = requestLabels{
+			query:   map[string]struct{}{},
+			headers: map[string]string{},
+		}
+		for _, name := range queryLabels {
+			a.options.requestLabels.query[name] = struct{}{}
+		}
+		for header, name := range headerLabels {
+			a.options.requestLabels.headers[http.CanonicalHeaderKey(header)] = name
+		}
+	}
+}
+
+// ValidateQueryLabels checks the names of labels allowed as query
+// parameters
+func ValidateQueryLabels(names []string) error {
+	for _, name := range names {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid query label name %q", name)
+		}
+	}
+	return nil
+}
+
+// ParseHeaderLabels parses header=label pairs mapping request headers to the
+// labels they set
+func ParseHeaderLabels(pairs []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range pairs {
+		header, name, found := strings.Cut(pair, "=")
+		if !found || header == "" {
+			return nil, fmt.Errorf("header label %q must be header=label", pair)
+		}
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q for header %s", name, header)
+		}
+		headers[header] = name
+	}
+	return headers, nil
+}
+
+// withRequestLabels adds the allowed labels from query parameters and
+// headers to those parsed from the path. Path labels take precedence over
+// query parameters, which take precedence over headers.
+func (rl requestLabels) withRequestLabels(c *gin.Context, labels []labelPair) []labelPair {
+	if len(rl.query) == 0 && len(rl.headers) == 0 {
+		return labels
+	}
+
+	set := make(map[string]struct{}, len(labels))
+	for _, l := range labels {
+		set[l.name] = struct{}{}
+	}
+	add := func(name, value string) {
+		if _, found := set[name]; !found {
+			set[name] = struct{}{}
+			labels = append(labels, labelPair{name, value})
+		}
+	}
+
+	query := c.Request.URL.Query()
+	names := make([]string, 0, len(rl.query))
+	for name := range rl.query {
+		if _, found := query[name]; found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name, query.Get(name))
+	}
+
+	headers := make([]string, 0, len(rl.headers))
+	for header := range rl.headers {
+		if _, found := c.Request.Header[header]; found {
+			headers = append(headers, header)
+		}
+	}
+	sort.Strings(headers)
+	for _, header := range headers {
+		add(rl.headers[header], c.Request.Header.Get(header))
+	}
+
+	return labels
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeaderLabels(t *testing.T) {
+	headers, err := ParseHeaderLabels([]string{"X-App-Version=app_version", "x-region=region"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"X-App-Version": "app_version", "x-region": "region"}, headers)
+
+	_, err = ParseHeaderLabels([]string{"X-App-Version"})
+	assert.EqualError(t, err, `header label "X-App-Version" must be header=label`)
+
+	_, err = ParseHeaderLabels([]string{"X-App-Version=app-version"})
+	assert.EqualError(t, err, `invalid label name "app-version" for header X-App-Version`)
+
+	assert.NoError(t, ValidateQueryLabels([]string{"app"}))
+	assert.EqualError(t, ValidateQueryLabels([]string{"0app"}), `invalid query label name "0app"`)
+}
+
+func TestWithRequestLabels(t *testing.T) {
+	a := NewAggregate(SetRequestLabels(
+		[]string{"app", "job", "region"},
+		map[string]string{"x-app-version": "app_version", "X-Region": "region"},
+	))
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/metrics/job/web?app=shop&job=spoofed&secret=1&partial=true", nil)
+	c.Request.Header.Set("X-App-Version", "1.2.3")
+	c.Request.Header.Set("X-Region", "eu")
+	c.Request.Header.Set("X-Other", "ignored")
+
+	labels := a.options.requestLabels.withRequestLabels(c, []labelPair{{"job", "web"}})
+
+	// path labels win over query parameters, which win over headers, and
+	// anything not allowed is left out
+	assert.Equal(t, []labelPair{
+		{"job", "web"},
+		{"app", "shop"},
+		{"app_version", "1.2.3"},
+		{"region", "eu"},
+	}, labels)
+
+	c.Request = httptest.NewRequest("POST", "/metrics?region=us", nil)
+	c.Request.Header.Set("X-Region", "eu")
+	labels = a.options.requestLabels.withRequestLabels(c, nil)
+	assert.Equal(t, []labelPair{{"region", "us"}}, labels)
+}
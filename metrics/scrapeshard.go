@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var ErrInvalidScrapeShard = errors.New("invalid scrape shard")
+
+// scrapeShard is the slice of the gateway a scrape renders, so several
+// scrape jobs can each pull a disjoint part of it. Families or series are
+// assigned to one of count shards by a hash of their name or labels.
+type scrapeShard struct {
+	index, count uint64
+	bySeries     bool
+}
+
+// parseScrapeShard reads the shard=i&shards=n parameters of a scrape,
+// returning nil if the scrape isn't sharded. With shardBy=series, the
+// series of a family are spread over the shards, rather than whole families.
+func parseScrapeShard(c *gin.Context) (*scrapeShard, error) {
+	shardParam, hasShard := c.GetQuery("shard")
+	countParam, hasCount := c.GetQuery("shards")
+	by, hasBy := c.GetQuery("shardBy")
+	if !hasShard && !hasCount && !hasBy {
+		return nil, nil
+	}
+	if !hasShard || !hasCount {
+		return nil, fmt.Errorf("%w: shard and shards must be set together", ErrInvalidScrapeShard)
+	}
+
+	count, err := strconv.ParseUint(countParam, 10, 64)
+	if err != nil || count == 0 {
+		return nil, fmt.Errorf("%w: shards must be a positive integer, got %q", ErrInvalidScrapeShard, countParam)
+	}
+	index, err := strconv.ParseUint(shardParam, 10, 64)
+	if err != nil || index >= count {
+		return nil, fmt.Errorf("%w: shard must be an integer from 0 to %d, got %q", ErrInvalidScrapeShard, count-1, shardParam)
+	}
+
+	shard := &scrapeShard{index: index, count: count}
+	switch by {
+	case "", "family":
+	case "series":
+		shard.bySeries = true
+	default:
+		return nil, fmt.Errorf("%w: shardBy must be family or series, got %q", ErrInvalidScrapeShard, by)
+	}
+	return shard, nil
+}
+
+func familyHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// includesFamily reports whether the named family is in the shard. When
+// sharding by series, every family may have series in it.
+func (s *scrapeShard) includesFamily(name string) bool {
+	return s.bySeries || familyHash(name)%s.count == s.index
+}
+
+// seriesFilter returns which series of the family are in the shard, or nil
+// when sharding whole families
+func (s *scrapeShard) seriesFilter(family string) func(m *dto.Metric) bool {
+	if !s.bySeries {
+		return nil
+	}
+	// the family name is mixed in, so series with the same labels in
+	// different families are spread over the shards too
+	hash := familyHash(family)
+	return func(m *dto.Metric) bool {
+		return (hash^uint64(fingerprintLabels(m.Label)))%s.count == s.index
+	}
+}
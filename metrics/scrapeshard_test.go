@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScrapeShard(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected *scrapeShard
+		err      string
+	}{
+		{"", nil, ""},
+		{"shard=0&shards=1", &scrapeShard{index: 0, count: 1}, ""},
+		{"shard=2&shards=3&shardBy=family", &scrapeShard{index: 2, count: 3}, ""},
+		{"shard=1&shards=3&shardBy=series", &scrapeShard{index: 1, count: 3, bySeries: true}, ""},
+		{"shard=1", nil, "invalid scrape shard: shard and shards must be set together"},
+		{"shardBy=series", nil, "invalid scrape shard: shard and shards must be set together"},
+		{"shard=0&shards=0", nil, `invalid scrape shard: shards must be a positive integer, got "0"`},
+		{"shard=0&shards=two", nil, `invalid scrape shard: shards must be a positive integer, got "two"`},
+		{"shard=3&shards=3", nil, `invalid scrape shard: shard must be an integer from 0 to 2, got "3"`},
+		{"shard=-1&shards=3", nil, `invalid scrape shard: shard must be an integer from 0 to 2, got "-1"`},
+		{"shard=0&shards=3&shardBy=label", nil, `invalid scrape shard: shardBy must be family or series, got "label"`},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.query), func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/metrics?"+test.query, nil)
+
+			shard, err := parseScrapeShard(c)
+			if test.err != "" {
+				assert.ErrorIs(t, err, ErrInvalidScrapeShard)
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, shard)
+		})
+	}
+}
+
+func TestScrapeShards(t *testing.T) {
+	a := NewAggregate()
+	var body strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&body, "# TYPE family_%d counter\n", i)
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&body, "family_%d{instance=\"%d\"} 1\n", i, j)
+		}
+	}
+	require.NoError(t, a.parseAndMerge(strings.NewReader(body.String()), nil))
+
+	render := func(shard *scrapeShard) []string {
+		buf := new(bytes.Buffer)
+		a.encodeMetrics(buf, expfmt.FmtText, []seriesFilter{shard.seriesFilter}, shard.includesFamily)
+		var series []string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				series = append(series, line)
+			}
+		}
+		return series
+	}
+
+	for _, bySeries := range []bool{false, true} {
+		t.Run(fmt.Sprintf("by_series_%t", bySeries), func(t *testing.T) {
+			// every series is rendered by exactly one shard
+			seen := map[string]int{}
+			for i := uint64(0); i < 3; i++ {
+				series := render(&scrapeShard{index: i, count: 3, bySeries: bySeries})
+				assert.NotEmpty(t, series)
+				for _, s := range series {
+					seen[s]++
+				}
+			}
+			assert.Len(t, seen, 200)
+			for s, count := range seen {
+				assert.Equal(t, 1, count, s)
+			}
+		})
+	}
+
+	// sharding by family keeps every family whole
+	families := map[string]int{}
+	for _, s := range render(&scrapeShard{index: 0, count: 3}) {
+		families[s[:strings.Index(s, "{")]]++
+	}
+	for family, count := range families {
+		assert.Equal(t, 10, count, family)
+	}
+}
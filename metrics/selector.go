@@ -0,0 +1,327 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+var ErrInvalidSelector = errors.New("invalid series selector")
+
+type matchType string
+
+const (
+	matchEqual     matchType = "="
+	matchNotEqual  matchType = "!="
+	matchRegexp    matchType = "=~"
+	matchNotRegexp matchType = "!~"
+)
+
+// labelMatcher matches the value of one label, like a PromQL label matcher.
+// A series without the label matches as if its value was empty.
+type labelMatcher struct {
+	name  string
+	typ   matchType
+	value string
+	re    *regexp.Regexp
+}
+
+func newLabelMatcher(name string, typ matchType, value string) (labelMatcher, error) {
+	m := labelMatcher{name: name, typ: typ, value: value}
+	if typ == matchRegexp || typ == matchNotRegexp {
+		// like PromQL, regular expressions match the whole value
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.typ {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// seriesSelector selects series by their family name and labels, like a
+// PromQL series selector such as requests{code=~"5.."}. The name of a
+// histogram or summary is the name of its family, without the _bucket,
+// _sum or _count suffixes.
+type seriesSelector []labelMatcher
+
+// matchesFamily reports whether the selector may select series of the named
+// family
+func (s seriesSelector) matchesFamily(name string) bool {
+	for _, m := range s {
+		if m.name == model.MetricNameLabel && !m.matches(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectsFamily reports whether the selector selects every series of the
+// named family, without needing to check their labels
+func (s seriesSelector) selectsFamily(name string) bool {
+	for _, m := range s {
+		if m.name != model.MetricNameLabel {
+			return false
+		}
+	}
+	return s.matchesFamily(name)
+}
+
+func (s seriesSelector) matchesSeries(family string, series *dto.Metric) bool {
+	for _, m := range s {
+		value := family
+		if m.name != model.MetricNameLabel {
+			value = labelValue(series, m.name)
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelValue(series *dto.Metric, name string) string {
+	for _, l := range series.Label {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// seriesSelectors selects the series selected by any of them, like the
+// match[] parameters of the Prometheus API
+type seriesSelectors []seriesSelector
+
+// parseSelectors parses every selector, returning nil if there are none
+func parseSelectors(inputs []string) (seriesSelectors, error) {
+	var selectors seriesSelectors
+	for _, input := range inputs {
+		selector, err := parseSelector(input)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+func (ss seriesSelectors) matchesFamily(name string) bool {
+	for _, s := range ss {
+		if s.matchesFamily(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesFilter returns which series of the family are selected, or nil if
+// all of them are
+func (ss seriesSelectors) seriesFilter(family string) func(m *dto.Metric) bool {
+	var matching seriesSelectors
+	for _, s := range ss {
+		if s.selectsFamily(family) {
+			return nil
+		}
+		if s.matchesFamily(family) {
+			matching = append(matching, s)
+		}
+	}
+	return func(m *dto.Metric) bool {
+		for _, s := range matching {
+			if s.matchesSeries(family, m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// parseSelector parses a PromQL series selector: an optional metric name
+// followed by optional label matchers in braces
+func parseSelector(input string) (seriesSelector, error) {
+	p := selectorParser{input: input}
+	var selector seriesSelector
+
+	p.skipSpace()
+	if name := p.identifier(true); name != "" {
+		selector = append(selector, labelMatcher{name: model.MetricNameLabel, typ: matchEqual, value: name})
+	}
+
+	p.skipSpace()
+	if p.consume("{") {
+		for {
+			p.skipSpace()
+			if p.consume("}") {
+				break
+			}
+			matcher, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			selector = append(selector, matcher)
+
+			p.skipSpace()
+			if p.consume(",") {
+				continue
+			}
+			if p.consume("}") {
+				break
+			}
+			return nil, p.errorf("expected \",\" or \"}\"")
+		}
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	// like PromQL, a selector matching every series is refused
+	for _, m := range selector {
+		if !m.matches("") {
+			return selector, nil
+		}
+	}
+	return nil, p.errorf("at least one matcher must not match the empty string")
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w %q: %s at position %d", ErrInvalidSelector, p.input, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\n\r", rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *selectorParser) consume(token string) bool {
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// identifier reads a label name, or a metric name, which may also contain
+// colons
+func (p *selectorParser) identifier(metricName bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(p.pos > start && c >= '0' && c <= '9') ||
+			(metricName && c == ':')
+		if !valid {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *selectorParser) matcher() (labelMatcher, error) {
+	name := p.identifier(false)
+	if name == "" {
+		return labelMatcher{}, p.errorf("expected a label name")
+	}
+
+	p.skipSpace()
+	var typ matchType
+	switch {
+	case p.consume(string(matchRegexp)):
+		typ = matchRegexp
+	case p.consume(string(matchNotRegexp)):
+		typ = matchNotRegexp
+	case p.consume(string(matchNotEqual)):
+		typ = matchNotEqual
+	case p.consume(string(matchEqual)):
+		typ = matchEqual
+	default:
+		return labelMatcher{}, p.errorf("expected one of =, !=, =~ or !~ after %q", name)
+	}
+
+	p.skipSpace()
+	value, err := p.quoted()
+	if err != nil {
+		return labelMatcher{}, err
+	}
+	matcher, err := newLabelMatcher(name, typ, value)
+	if err != nil {
+		return labelMatcher{}, p.errorf("%v", err)
+	}
+	return matcher, nil
+}
+
+// quoted reads a string in double quotes, single quotes or backticks, with
+// the escapes of Go strings inside quotes
+func (p *selectorParser) quoted() (string, error) {
+	if p.pos >= len(p.input) || !strings.ContainsRune("\"'`", rune(p.input[p.pos])) {
+		return "", p.errorf("expected a quoted label value")
+	}
+
+	quote := p.input[p.pos]
+	end := p.pos + 1
+	for end < len(p.input) && p.input[end] != quote {
+		if p.input[end] == '\\' && quote != '`' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.input) {
+		return "", p.errorf("unterminated label value")
+	}
+
+	literal := p.input[p.pos : end+1]
+	if quote == '\'' {
+		// Go only allows single characters in single quotes
+		var converted strings.Builder
+		converted.WriteByte('"')
+		for i := 1; i < len(literal)-1; i++ {
+			switch c := literal[i]; {
+			case c == '\\' && literal[i+1] == '\'':
+				converted.WriteByte('\'')
+				i++
+			case c == '\\':
+				converted.WriteString(literal[i : i+2])
+				i++
+			case c == '"':
+				converted.WriteString(`\"`)
+			default:
+				converted.WriteByte(c)
+			}
+		}
+		converted.WriteByte('"')
+		literal = converted.String()
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		return "", p.errorf("invalid label value %s", p.input[p.pos:end+1])
+	}
+	p.pos = end + 1
+	return value, nil
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		matches  []string
+		err      string
+	}{
+		{"requests", []string{`__name__="requests"`}, ""},
+		{`requests{code="200"}`, []string{`__name__="requests"`, `code="200"`}, ""},
+		{` job:requests:rate5m { code != '5\'00' , path=~"/api/.*", method!~` + "`GET|HEAD`" + `, } `, []string{`__name__="job:requests:rate5m"`, `code!="5'00"`, `path=~"/api/.*"`, `method!~"GET|HEAD"`}, ""},
+		{`{__name__=~"requests|errors"}`, []string{`__name__=~"requests|errors"`}, ""},
+		{`{path="a\"b\n"}`, []string{`path="a\"b\n"`}, ""},
+		{"", nil, `invalid series selector "": at least one matcher must not match the empty string at position 0`},
+		{`{code=~".*"}`, nil, `invalid series selector "{code=~\".*\"}": at least one matcher must not match the empty string at position 12`},
+		{`requests{code}`, nil, `invalid series selector "requests{code}": expected one of =, !=, =~ or !~ after "code" at position 13`},
+		{`requests{code="200"`, nil, `invalid series selector "requests{code=\"200\"": expected "," or "}" at position 19`},
+		{`requests{code="200}`, nil, `invalid series selector "requests{code=\"200}": unterminated label value at position 14`},
+		{`requests{code=200}`, nil, `invalid series selector "requests{code=200}": expected a quoted label value at position 14`},
+		{`requests{code=~"("}`, nil, "invalid series selector \"requests{code=~\\\"(\\\"}\": error parsing regexp: missing closing ): `^(?:()$` at position 18"},
+		{`requests errors`, nil, `invalid series selector "requests errors": unexpected "errors" at position 9`},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.selector), func(t *testing.T) {
+			selector, err := parseSelector(test.selector)
+			if test.err != "" {
+				require.Error(t, err)
+				assert.ErrorIs(t, err, ErrInvalidSelector)
+				assert.Equal(t, test.err, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			matches := make([]string, 0, len(selector))
+			for _, m := range selector {
+				matches = append(matches, fmt.Sprintf("%s%s%q", m.name, m.typ, m.value))
+			}
+			assert.Equal(t, test.matches, matches)
+		})
+	}
+}
+
+func TestRenderSelectedSeries(t *testing.T) {
+	a := NewAggregate()
+	require.NoError(t, a.parseAndMerge(strings.NewReader(`# TYPE requests counter
+requests{code="200",path="/"} 1
+requests{code="500",path="/"} 1
+requests{code="503",path="/api"} 1
+# TYPE errors counter
+errors{path="/"} 1
+# TYPE uptime gauge
+uptime 1
+`), nil))
+
+	tests := []struct {
+		name     string
+		match    []string
+		expected string
+	}{
+		{
+			"family by name",
+			[]string{"uptime"},
+			"# TYPE uptime gauge\nuptime 1\n",
+		},
+		{
+			"series by label",
+			[]string{`requests{code=~"5.."}`},
+			"# TYPE requests counter\nrequests{code=\"500\",path=\"/\"} 1\nrequests{code=\"503\",path=\"/api\"} 1\n",
+		},
+		{
+			"series of every family",
+			[]string{`{path="/"}`},
+			"# TYPE errors counter\nerrors{path=\"/\"} 1\n# TYPE requests counter\nrequests{code=\"200\",path=\"/\"} 1\nrequests{code=\"500\",path=\"/\"} 1\n",
+		},
+		{
+			"missing labels match empty values",
+			[]string{`{__name__=~"requests|uptime",code!~"5.."}`},
+			"# TYPE requests counter\nrequests{code=\"200\",path=\"/\"} 1\n# TYPE uptime gauge\nuptime 1\n",
+		},
+		{
+			"union of selectors",
+			[]string{`requests{code="200"}`, `errors`, `requests{path="/api"}`},
+			"# TYPE errors counter\nerrors{path=\"/\"} 1\n# TYPE requests counter\nrequests{code=\"200\",path=\"/\"} 1\nrequests{code=\"503\",path=\"/api\"} 1\n",
+		},
+		{
+			"nothing selected",
+			[]string{`requests{code="404"}`},
+			"",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			selectors, err := parseSelectors(test.match)
+			require.NoError(t, err)
+			buf := new(bytes.Buffer)
+			a.encodeMetrics(buf, expfmt.FmtText, []seriesFilter{selectors.seriesFilter}, selectors.matchesFamily)
+			assert.Equal(t, test.expected, buf.String())
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// metricFamily is a stored family. Its series are kept in a seriesMap
+// rather than in MetricFamily.Metric, so merging a push only touches the
+// series it carries.
+type metricFamily struct {
+	*dto.MetricFamily
+	series seriesMap
+	lock   sync.RWMutex
+	// version counts the changes to the family, so renders know when
+	// their cached encoding is stale
+	version uint64
+	render  renderCache
+}
+
+// newMetricFamily stores a pushed family, taking ownership of its series.
+// The tracker is told about every series added to or removed from the
+// family, unless it is nil.
+func newMetricFamily(family *dto.MetricFamily, tracker *seriesTracker) *metricFamily {
+	mf := &metricFamily{MetricFamily: family, series: newSeriesMap(len(family.Metric), tracker)}
+	tracker.addBytes(familyOverhead)
+	for _, m := range family.Metric {
+		mf.series.set(fingerprintLabels(m.Label), m)
+	}
+	family.Metric = nil
+	return mf
+}
+
+// len returns the number of series in the family. The family must be
+// locked.
+func (mf *metricFamily) len() int {
+	return mf.series.count
+}
+
+// sortedSeries returns the series of the family sorted by their labels, as
+// they are rendered. The family must be locked.
+func (mf *metricFamily) sortedSeries() []*dto.Metric {
+	series := make([]*dto.Metric, 0, mf.series.count)
+	mf.series.each(func(m *dto.Metric) {
+		series = append(series, m)
+	})
+	sort.Sort(byLabel(series))
+	return series
+}
+
+// snapshot returns a copy of the family with its series sorted, to render
+// or merge elsewhere. The family must be locked.
+func (mf *metricFamily) snapshot() *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   mf.Name,
+		Help:   mf.Help,
+		Type:   mf.Type,
+		Metric: mf.sortedSeries(),
+	}
+}
+
+// release tells the tracker the family's series are gone, once the family
+// is no longer stored
+func (mf *metricFamily) release() {
+	tracker := mf.series.tracker
+	if tracker == nil {
+		return
+	}
+	mf.lock.RLock()
+	defer mf.lock.RUnlock()
+	if tracker.interned != nil {
+		mf.series.each(func(m *dto.Metric) {
+			tracker.interned.releaseLabels(m.Label)
+		})
+	}
+	tracker.addBytes(-mf.series.bytes - familyOverhead)
+}
+
+// removeSeries removes the series carrying all of the labels, returning how
+// many were removed. The family must be locked for writing.
+func (mf *metricFamily) removeSeries(labels []labelPair) int {
+	return mf.removeSeriesWhere(func(m *dto.Metric) bool {
+		return seriesHasLabels(m, labels)
+	})
+}
+
+// removeSeriesWhere removes every series matching the filter, returning how
+// many were removed. The family must be locked for writing.
+func (mf *metricFamily) removeSeriesWhere(filter func(m *dto.Metric) bool) int {
+	mf.version++
+	var removed []*dto.Metric
+	mf.series.each(func(m *dto.Metric) {
+		if filter(m) {
+			removed = append(removed, m)
+		}
+	})
+	for _, m := range removed {
+		mf.series.delete(fingerprintLabels(m.Label), m.Label)
+	}
+	return len(removed)
+}
+
+// countSeries returns how many series carry all of the labels. The family
+// must be locked.
+func (mf *metricFamily) countSeries(labels []labelPair) int {
+	count := 0
+	mf.series.each(func(m *dto.Metric) {
+		if seriesHasLabels(m, labels) {
+			count++
+		}
+	})
+	return count
+}
+
+// seriesEntry is a stored series and when it was last pushed to
+type seriesEntry struct {
+	metric  *dto.Metric
+	updated int64
+}
+
+// seriesMap indexes series by the fingerprint of their labels. Series whose
+// fingerprint is already taken by a series with different labels are kept
+// in collisions, so a hash collision never merges unrelated series.
+type seriesMap struct {
+	series     map[model.Fingerprint]seriesEntry
+	collisions map[model.Fingerprint][]seriesEntry
+	count      int
+	// bytes is the approximate memory used by the series
+	bytes   int64
+	tracker *seriesTracker
+}
+
+func newSeriesMap(size int, tracker *seriesTracker) seriesMap {
+	return seriesMap{series: make(map[model.Fingerprint]seriesEntry, size), tracker: tracker}
+}
+
+func (s *seriesMap) get(fp model.Fingerprint, labels []*dto.LabelPair) (*dto.Metric, bool) {
+	if e, ok := s.series[fp]; ok && labelsEqual(e.metric.Label, labels) {
+		return e.metric, true
+	}
+	for _, e := range s.collisions[fp] {
+		if labelsEqual(e.metric.Label, labels) {
+			return e.metric, true
+		}
+	}
+	return nil, false
+}
+
+// set adds a series, or replaces the one with the same labels, keeping
+// the labels of the series it replaces
+func (s *seriesMap) set(fp model.Fingerprint, m *dto.Metric) {
+	entry := seriesEntry{metric: m, updated: s.tracker.timestamp()}
+
+	existing, ok := s.series[fp]
+	if !ok {
+		s.add(m)
+		s.series[fp] = entry
+		return
+	}
+	if labelsEqual(existing.metric.Label, m.Label) {
+		s.replace(existing.metric, m)
+		s.series[fp] = entry
+		return
+	}
+
+	for i, collision := range s.collisions[fp] {
+		if labelsEqual(collision.metric.Label, m.Label) {
+			s.replace(collision.metric, m)
+			s.collisions[fp][i] = entry
+			return
+		}
+	}
+	if s.collisions == nil {
+		s.collisions = map[model.Fingerprint][]seriesEntry{}
+	}
+	s.add(m)
+	s.collisions[fp] = append(s.collisions[fp], entry)
+}
+
+func (s *seriesMap) add(m *dto.Metric) {
+	if s.tracker != nil && s.tracker.interned != nil {
+		s.tracker.interned.internLabels(m.Label)
+	}
+	s.count++
+	s.addBytes(seriesSize(m))
+}
+
+func (s *seriesMap) replace(old, m *dto.Metric) {
+	m.Label = old.Label
+	s.addBytes(seriesSize(m) - seriesSize(old))
+}
+
+func (s *seriesMap) removed(m *dto.Metric) {
+	if s.tracker != nil && s.tracker.interned != nil {
+		s.tracker.interned.releaseLabels(m.Label)
+	}
+	s.count--
+	s.addBytes(-seriesSize(m))
+}
+
+func (s *seriesMap) addBytes(delta int64) {
+	s.bytes += delta
+	s.tracker.addBytes(delta)
+}
+
+func (s *seriesMap) delete(fp model.Fingerprint, labels []*dto.LabelPair) {
+	collisions := s.collisions[fp]
+	if e, ok := s.series[fp]; ok && labelsEqual(e.metric.Label, labels) {
+		if len(collisions) > 0 {
+			// promote a colliding series to take its place
+			s.series[fp] = collisions[0]
+			collisions = collisions[1:]
+		} else {
+			delete(s.series, fp)
+		}
+		s.removed(e.metric)
+	} else {
+		for i, e := range collisions {
+			if labelsEqual(e.metric.Label, labels) {
+				collisions = append(collisions[:i:i], collisions[i+1:]...)
+				s.removed(e.metric)
+				break
+			}
+		}
+	}
+
+	if len(collisions) == 0 {
+		delete(s.collisions, fp)
+	} else {
+		s.collisions[fp] = collisions
+	}
+}
+
+func (s *seriesMap) each(fn func(m *dto.Metric)) {
+	s.eachEntry(func(e seriesEntry) {
+		fn(e.metric)
+	})
+}
+
+func (s *seriesMap) eachEntry(fn func(e seriesEntry)) {
+	for _, e := range s.series {
+		fn(e)
+	}
+	for _, collisions := range s.collisions {
+		for _, e := range collisions {
+			fn(e)
+		}
+	}
+}
+
+// fingerprintLabels hashes labels already sorted by name with FNV-1a, like
+// model.LabelSet.Fingerprint but without building a LabelSet
+func fingerprintLabels(labels []*dto.LabelPair) model.Fingerprint {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+		// separator can't occur in valid label names or values
+		separator = 0xff
+	)
+
+	hash := uint64(offset64)
+	add := func(s string) {
+		for i := 0; i < len(s); i++ {
+			hash ^= uint64(s[i])
+			hash *= prime64
+		}
+		hash ^= separator
+		hash *= prime64
+	}
+	for _, l := range labels {
+		add(l.GetName())
+		add(l.GetValue())
+	}
+	return model.Fingerprint(hash)
+}
+
+func labelsEqual(a, b []*dto.LabelPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].GetName() != b[i].GetName() || a[i].GetValue() != b[i].GetValue() {
+			return false
+		}
+	}
+	return true
+}
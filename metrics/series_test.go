@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counterSeries(value float64, labels ...string) *dto.Metric {
+	m := &dto.Metric{Counter: &dto.Counter{Value: float64ptr(value)}}
+	for i := 0; i < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: strPtr(labels[i]), Value: strPtr(labels[i+1])})
+	}
+	return m
+}
+
+func counterFamily(name string, series ...*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: strPtr(name), Type: dto.MetricType_COUNTER.Enum(), Metric: series}
+}
+
+func seriesValues(mf *metricFamily) []string {
+	values := []string{}
+	for _, m := range mf.sortedSeries() {
+		values = append(values, fmt.Sprintf("%s=%v", m.Label[0].GetValue(), m.GetCounter().GetValue()))
+	}
+	return values
+}
+
+func TestMergeFamilySeries(t *testing.T) {
+	mf := newMetricFamily(counterFamily("requests",
+		counterSeries(1, "code", "200"),
+		counterSeries(2, "code", "500"),
+	), nil)
+	require.NoError(t, mf.mergeFamily(counterFamily("requests",
+		counterSeries(3, "code", "500"),
+		counterSeries(4, "code", "404"),
+	)))
+
+	assert.Equal(t, 3, mf.len())
+	assert.Equal(t, []string{"200=1", "404=4", "500=5"}, seriesValues(mf))
+
+	assert.Equal(t, 1, mf.countSeries([]labelPair{{"code", "404"}}))
+	assert.Equal(t, 1, mf.removeSeries([]labelPair{{"code", "404"}}))
+	assert.Equal(t, 2, mf.len())
+}
+
+func TestSeriesMapCollisions(t *testing.T) {
+	a := counterSeries(1, "code", "200")
+	b := counterSeries(2, "code", "500")
+	c := counterSeries(3, "code", "404")
+
+	// every series is given the same fingerprint, as if their hashes
+	// collided
+	s := newSeriesMap(0, nil)
+	s.set(1, a)
+	s.set(1, b)
+	s.set(1, c)
+	s.set(1, counterSeries(4, "code", "500"))
+	assert.Equal(t, 3, s.count)
+
+	m, ok := s.get(1, b.Label)
+	require.True(t, ok)
+	assert.Equal(t, 4.0, m.GetCounter().GetValue())
+	_, ok = s.get(2, b.Label)
+	assert.False(t, ok)
+
+	s.delete(1, a.Label)
+	assert.Equal(t, 2, s.count)
+	_, ok = s.get(1, a.Label)
+	assert.False(t, ok)
+	_, ok = s.get(1, c.Label)
+	assert.True(t, ok)
+
+	s.delete(1, c.Label)
+	s.delete(1, b.Label)
+	assert.Equal(t, 0, s.count)
+	assert.Empty(t, s.series)
+	assert.Empty(t, s.collisions)
+}
+
+func TestFingerprintLabels(t *testing.T) {
+	assert.Equal(t,
+		fingerprintLabels(counterSeries(1, "a", "b", "c", "d").Label),
+		fingerprintLabels(counterSeries(2, "a", "b", "c", "d").Label),
+	)
+	// the separator keeps names and values from running into each other
+	assert.NotEqual(t,
+		fingerprintLabels(counterSeries(1, "a", "bc").Label),
+		fingerprintLabels(counterSeries(1, "ab", "c").Label),
+	)
+}
+
+// BenchmarkPushToLargeFamily pushes a few series to families of growing
+// size. The cost of a push depends on the series it carries, not on how
+// many are already stored.
+func BenchmarkPushToLargeFamily(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("series_%d", size), func(b *testing.B) {
+			a := NewAggregate()
+			series := make([]*dto.Metric, 0, size)
+			for i := 0; i < size; i++ {
+				series = append(series, counterSeries(1, "instance", fmt.Sprintf("%d", i)))
+			}
+			if err := a.mergeFamilies(map[string]*dto.MetricFamily{"requests": counterFamily("requests", series...)}, testLabels); err != nil {
+				b.Fatalf("unexpected error %s", err)
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				push := counterFamily("requests")
+				for i := 0; i < 10; i++ {
+					push.Metric = append(push.Metric, counterSeries(1, "instance", fmt.Sprintf("%d", (n*10+i)%size)))
+				}
+				if err := a.mergeFamilies(map[string]*dto.MetricFamily{"requests": push}, testLabels); err != nil {
+					b.Fatalf("unexpected error %s", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultFamilyShards is the number of shards families are spread over, so
+// pushes to different families rarely wait on the same lock
+const defaultFamilyShards = 32
+
+// familyShard holds the families whose names hash to it
+type familyShard struct {
+	lock     sync.RWMutex
+	families map[string]*metricFamily
+}
+
+// familyShards spreads families over shards by a hash of their name, each
+// with its own lock. Pushes only lock the shards of the families they touch,
+// and scrapes only hold a shard lock long enough to list its families.
+type familyShards struct {
+	shards []*familyShard
+	count  atomic.Int64
+}
+
+func newFamilyShards(n int) *familyShards {
+	s := &familyShards{shards: make([]*familyShard, n)}
+	for i := range s.shards {
+		s.shards[i] = &familyShard{families: map[string]*metricFamily{}}
+	}
+	return s
+}
+
+func (s *familyShards) index(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *familyShards) shard(name string) *familyShard {
+	return s.shards[s.index(name)]
+}
+
+// shardSet is a sorted set of shard indexes. Shards are always locked in
+// increasing order, so pushes locking several of them can't deadlock.
+type shardSet []int
+
+// shardsOf returns the shards holding the named families
+func (s *familyShards) shardsOf(names ...string) shardSet {
+	seen := map[int]struct{}{}
+	set := make(shardSet, 0, len(names))
+	for _, name := range names {
+		i := s.index(name)
+		if _, found := seen[i]; !found {
+			seen[i] = struct{}{}
+			set = append(set, i)
+		}
+	}
+	sort.Ints(set)
+	return set
+}
+
+// all returns every shard
+func (s *familyShards) all() shardSet {
+	set := make(shardSet, len(s.shards))
+	for i := range set {
+		set[i] = i
+	}
+	return set
+}
+
+func (s *familyShards) lock(set shardSet) {
+	for _, i := range set {
+		s.shards[i].lock.Lock()
+	}
+}
+
+func (s *familyShards) unlock(set shardSet) {
+	for idx := len(set) - 1; idx >= 0; idx-- {
+		s.shards[set[idx]].lock.Unlock()
+	}
+}
+
+// lookup returns the family stored under name. The shard of name must be
+// locked.
+func (s *familyShards) lookup(name string) (*metricFamily, bool) {
+	family, ok := s.shard(name).families[name]
+	return family, ok
+}
+
+// store adds or replaces the family stored under name. The shard of name
+// must be locked for writing.
+func (s *familyShards) store(name string, family *metricFamily) {
+	families := s.shard(name).families
+	if replaced, ok := families[name]; ok {
+		replaced.release()
+	} else {
+		s.count.Add(1)
+	}
+	families[name] = family
+}
+
+// remove deletes the family stored under name. The shard of name must be
+// locked for writing.
+func (s *familyShards) remove(name string) (*metricFamily, bool) {
+	families := s.shard(name).families
+	family, ok := families[name]
+	if ok {
+		delete(families, name)
+		s.count.Add(-1)
+		family.release()
+	}
+	return family, ok
+}
+
+// rangeLocked calls fn for every family in the shards of set, which must be
+// locked
+func (s *familyShards) rangeLocked(set shardSet, fn func(name string, family *metricFamily)) {
+	for _, i := range set {
+		for name, family := range s.shards[i].families {
+			fn(name, family)
+		}
+	}
+}
+
+func (s *familyShards) len() int {
+	return int(s.count.Load())
+}
+
+type namedFamily struct {
+	name   string
+	family *metricFamily
+}
+
+// snapshot returns every family sorted by name, holding each shard's lock
+// only while listing its families
+func (s *familyShards) snapshot() []namedFamily {
+	families := make([]namedFamily, 0, s.len())
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		for name, family := range shard.families {
+			families = append(families, namedFamily{name, family})
+		}
+		shard.lock.RUnlock()
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	return families
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFamilyShards(t *testing.T) {
+	s := newFamilyShards(4)
+
+	set := s.shardsOf("b", "a", "b")
+	assert.LessOrEqual(t, len(set), 2)
+	assert.IsIncreasing(t, []int(set))
+	assert.Equal(t, shardSet{0, 1, 2, 3}, s.all())
+
+	all := s.all()
+	s.lock(all)
+	for _, name := range []string{"c", "a", "b"} {
+		s.store(name, &metricFamily{})
+	}
+	s.store("a", &metricFamily{})
+	_, ok := s.lookup("a")
+	assert.True(t, ok)
+	_, ok = s.remove("c")
+	assert.True(t, ok)
+	_, ok = s.remove("c")
+	assert.False(t, ok)
+	s.unlock(all)
+
+	assert.Equal(t, 2, s.len())
+	names := []string{}
+	for _, f := range s.snapshot() {
+		names = append(names, f.name)
+	}
+	assert.Equal(t, []string{"a", "b"}, names)
+}
+
+func TestConcurrentPushAndRender(t *testing.T) {
+	a := NewAggregate(SetTypeConflictPolicy(TypeConflictKeepBoth))
+
+	// FailNow can't be called from the workers, so their errors are
+	// checked once they are done
+	const workers = 8
+	errs := make(chan error, workers*50)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				body := fmt.Sprintf("# TYPE family_%d counter\nfamily_%d{worker=\"%d\"} 1\n# TYPE shared counter\nshared 1\n", i%10, i%10, w)
+				if err := a.parseAndMerge(strings.NewReader(body), testLabels); err != nil {
+					errs <- err
+				}
+				if i%10 == 0 {
+					a.encodeAllMetrics(io.Discard, expfmt.FmtText)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 11, a.Len())
+
+	buf := new(bytes.Buffer)
+	a.encodeAllMetrics(buf, expfmt.FmtText)
+	assert.Contains(t, buf.String(), "shared{job=\"test\"} 400\n")
+	assert.Contains(t, buf.String(), "family_3{job=\"test\",worker=\"7\"} 5\n")
+}
+
+// BenchmarkMixedLoad pushes to many families while scraping, with a single
+// shard behaving like one global lock
+func BenchmarkMixedLoad(b *testing.B) {
+	const families = 200
+
+	var scrape strings.Builder
+	for i := 0; i < families; i++ {
+		fmt.Fprintf(&scrape, "# TYPE family_%d counter\n", i)
+		for j := 0; j < 20; j++ {
+			fmt.Fprintf(&scrape, "family_%d{instance=\"%d\"} 1\n", i, j)
+		}
+	}
+
+	for _, shards := range []int{1, defaultFamilyShards} {
+		b.Run(fmt.Sprintf("shards_%d", shards), func(b *testing.B) {
+			a := NewAggregate()
+			a.families = newFamilyShards(shards)
+			if err := a.parseAndMerge(strings.NewReader(scrape.String()), testLabels); err != nil {
+				b.Fatalf("unexpected error %s", err)
+			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := next.Add(1)
+					// one in ten operations is a full scrape
+					if n%10 == 0 {
+						a.encodeAllMetrics(io.Discard, expfmt.FmtText)
+						continue
+					}
+					body := fmt.Sprintf("# TYPE family_%d counter\nfamily_%d{instance=\"%d\"} 1\n", n%families, n%families, n%20)
+					if err := a.parseAndMerge(strings.NewReader(body), testLabels); err != nil {
+						b.Fatalf("unexpected error %s", err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,23 +1,173 @@
 package routers
 
 import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
 )
 
-func processAuthConfig(authList []string) gin.Accounts {
+const basicAuthRealm = `Basic realm="Authorization Required"`
+
+// processAuthConfig parses user=password accounts. Any malformed entry is an
+// error, as dropping it could leave no accounts and turn auth off.
+func processAuthConfig(authList []string) (gin.Accounts, error) {
 	authAccounts := gin.Accounts{}
 	if len(authList) == 0 {
-		return authAccounts
+		return authAccounts, nil
 	}
 
-	for _, item := range authList {
-		i := strings.Split(item, "=")
-		if len(i) == 2 {
-			authAccounts[i[0]] = i[1]
+	for idx, item := range authList {
+		// passwords may contain '=', so only split on the first one
+		i := strings.SplitN(item, "=", 2)
+		if len(i) != 2 || i[0] == "" {
+			// the entry isn't quoted, as it may hold a password
+			return nil, fmt.Errorf("auth user #%d must be user=password", idx+1)
 		}
+		authAccounts[i[0]] = i[1]
+	}
+
+	return authAccounts, nil
+}
+
+// credentialVerifier checks a user name and password pair
+type credentialVerifier interface {
+	verify(user, password string) bool
+}
+
+// staticAccounts verifies plaintext accounts passed on the command line
+type staticAccounts gin.Accounts
+
+func (sa staticAccounts) verify(user, password string) bool {
+	expected, ok := sa[user]
+	if !ok {
+		// compare anyway so unknown users take as long as known ones
+		subtle.ConstantTimeCompare([]byte(password), []byte(password))
+		return false
 	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
 
-	return authAccounts
+// authenticator checks the credentials of API requests against the
+// configured basic auth users, API tokens and JWT keys
+type authenticator struct {
+	verifiers []credentialVerifier
+	tokens    *tokenStore
+	jwt       *jwtVerifier
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.verifiers) > 0 || a.acceptsBearer()
+}
+
+func (a *authenticator) acceptsBearer() bool {
+	return a.tokens != nil || a.jwt != nil
+}
+
+// bearerToken returns the token from either an "Authorization: Bearer"
+// header or an "X-API-Key" header
+func bearerToken(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		kind, value, found := strings.Cut(auth, " ")
+		if found && strings.EqualFold(kind, "Bearer") {
+			return strings.TrimSpace(value), true
+		}
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+	return "", false
+}
+
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != ""
+}
+
+// require only lets through requests whose credentials grant s. Basic auth
+// users are trusted with every scope; API tokens are limited to their own
+// scopes, jobs and metric prefixes; JWTs may only push.
+func (a *authenticator) require(s scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if value, ok := bearerToken(c.Request); ok && a.acceptsBearer() {
+			a.authenticateBearer(c, s, value)
+			return
+		}
+
+		if user, password, ok := c.Request.BasicAuth(); ok {
+			for _, v := range a.verifiers {
+				if v.verify(user, password) {
+					c.Set(gin.AuthUserKey, user)
+					c.Next()
+					return
+				}
+			}
+		}
+
+		a.unauthorized(c)
+	}
+}
+
+func (a *authenticator) authenticateBearer(c *gin.Context, s scope, value string) {
+	if a.tokens != nil {
+		if t := a.tokens.lookup(value); t != nil {
+			if !t.hasScope(s) {
+				a.forbidden(c, "token %s does not have the %s scope", t.Name, s)
+				return
+			}
+			c.Set(gin.AuthUserKey, t.Name)
+			c.Set(metrics.PushPolicyKey, t)
+			c.Next()
+			return
+		}
+	}
+
+	if a.jwt != nil && looksLikeJWT(value) {
+		claims, err := a.jwt.verify(value)
+		if err != nil {
+			log.Printf("rejected jwt: %v", err)
+			a.unauthorized(c)
+			return
+		}
+		if s != scopePush {
+			a.forbidden(c, "jwt does not have the %s scope", s)
+			return
+		}
+		c.Set(gin.AuthUserKey, a.jwt.identity(claims))
+		c.Set(metrics.PushLabelsKey, a.jwt.labels(claims))
+		c.Next()
+		return
+	}
+
+	a.unauthorized(c)
+}
+
+// optional behaves like require when credentials are presented and lets
+// anonymous requests through untouched
+func (a *authenticator) optional(s scope) gin.HandlerFunc {
+	required := a.require(s)
+	return func(c *gin.Context) {
+		if !hasCredentials(c.Request) {
+			c.Next()
+			return
+		}
+		required(c)
+	}
+}
+
+func (a *authenticator) forbidden(c *gin.Context, format string, values ...interface{}) {
+	c.String(http.StatusForbidden, format, values...)
+	c.Abort()
+}
+
+func (a *authenticator) unauthorized(c *gin.Context) {
+	if len(a.verifiers) > 0 {
+		c.Header("WWW-Authenticate", basicAuthRealm)
+	} else {
+		c.Header("WWW-Authenticate", "Bearer")
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
 }
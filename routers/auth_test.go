@@ -5,7 +5,11 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	promMetrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
 )
 
 func TestProcessAuthConfig(t *testing.T) {
@@ -13,15 +17,41 @@ func TestProcessAuthConfig(t *testing.T) {
 		name     string
 		authList []string
 		accounts gin.Accounts
+		err      string
 	}{
-		{"basic 1", []string{"user=password"}, gin.Accounts{"user": "password"}},
-		{"two", []string{"user=password", "user1=password1"}, gin.Accounts{"user": "password", "user1": "password1"}},
+		{"basic 1", []string{"user=password"}, gin.Accounts{"user": "password"}, ""},
+		{"two", []string{"user=password", "user1=password1"}, gin.Accounts{"user": "password", "user1": "password1"}, ""},
+		{"equals in password", []string{"user=pass=word=="}, gin.Accounts{"user": "pass=word=="}, ""},
+		{"missing password", []string{"user=password", "user"}, nil, "auth user #2 must be user=password"},
+		{"missing user", []string{"=password"}, nil, "auth user #1 must be user=password"},
 	}
 
 	for idx, test := range tests {
 		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
-			a := processAuthConfig(test.authList)
+			a, err := processAuthConfig(test.authList)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
 			assert.Equal(t, test.accounts, a)
 		})
 	}
 }
+
+func TestStaticAccountsVerify(t *testing.T) {
+	accounts := staticAccounts{"user": "pass=word"}
+
+	assert.True(t, accounts.verify("user", "pass=word"))
+	assert.False(t, accounts.verify("user", "pass"))
+	assert.False(t, accounts.verify("other", "pass=word"))
+}
+
+func TestMalformedAuthUsersFailClosed(t *testing.T) {
+	// with every entry malformed, dropping them would leave pushes open
+	_, err := setupAPIRouter(ApiRouterConfig{CorsDomain: "*", Accounts: []string{"user"}}, metrics.NewAggregate(), promMetrics.Config{Registry: prometheus.NewRegistry()})
+	assert.EqualError(t, err, "auth user #1 must be user=password")
+
+	_, err = setupAPIRouter(ApiRouterConfig{CorsDomain: "*", ReadAccounts: []string{"prometheus"}}, metrics.NewAggregate(), promMetrics.Config{Registry: prometheus.NewRegistry()})
+	assert.EqualError(t, err, "read auth user #1 must be user=password")
+}
@@ -0,0 +1,159 @@
+package routers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	htpasswdSHAPrefix = "{SHA}"
+
+	// how often the htpasswd file is checked for changes
+	defaultHtpasswdReloadInterval = 5 * time.Second
+)
+
+// dummyBcryptHash is compared against when a user is unknown so that
+// lookups for missing users cost about as much as real ones
+var dummyBcryptHash = []byte("$2a$10$zXVyvbPjXRHt2aXpLhfLvephFCMATTCt.z4mggZLsGriOeeo4JnCi")
+
+// htpasswdFile verifies credentials against an Apache style htpasswd file.
+// The file is re-read when its modification time or size changes.
+type htpasswdFile struct {
+	path           string
+	reloadInterval time.Duration
+
+	lock      sync.RWMutex
+	users     map[string]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func newHtpasswdFile(path string, reloadInterval time.Duration) (*htpasswdFile, error) {
+	h := &htpasswdFile{
+		path:           path,
+		reloadInterval: reloadInterval,
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *htpasswdFile) load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users, err := parseHtpasswd(bufio.NewScanner(f))
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+
+	h.lock.Lock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.lastCheck = time.Now()
+	h.lock.Unlock()
+
+	return nil
+}
+
+func parseHtpasswd(scanner *bufio.Scanner) (map[string]string, error) {
+	users := map[string]string{}
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", lineNumber)
+		}
+		if !isSupportedHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %s, only bcrypt and {SHA} are supported", lineNumber, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func isSupportedHash(hash string) bool {
+	if strings.HasPrefix(hash, htpasswdSHAPrefix) {
+		return true
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// reloadIfChanged re-reads the file when it has changed on disk. Errors are
+// logged and the previous set of users is kept.
+func (h *htpasswdFile) reloadIfChanged() {
+	h.lock.RLock()
+	due := time.Since(h.lastCheck) >= h.reloadInterval
+	h.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		log.Printf("unable to stat htpasswd file %s: %v", h.path, err)
+		return
+	}
+
+	h.lock.Lock()
+	changed := !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+	h.lastCheck = time.Now()
+	h.lock.Unlock()
+
+	if changed {
+		if err := h.load(); err != nil {
+			log.Printf("unable to reload htpasswd file: %v", err)
+		}
+	}
+}
+
+func (h *htpasswdFile) verify(user, password string) bool {
+	h.reloadIfChanged()
+
+	h.lock.RLock()
+	hash, ok := h.users[user]
+	h.lock.RUnlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password))
+		return false
+	}
+	return compareHtpasswdHash(hash, password)
+}
+
+func compareHtpasswdHash(hash, password string) bool {
+	if strings.HasPrefix(hash, htpasswdSHAPrefix) {
+		sum := sha1.Sum([]byte(password))
+		expected := htpasswdSHAPrefix + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
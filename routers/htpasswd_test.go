@@ -0,0 +1,96 @@
+package routers
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// password "secret=pass"
+	testBcryptHash = "$2a$04$Idn2OMqzpdB5B6YJiWXo.uThfbrryV1ABhaj0Tet0WP2zCpo1.YQG"
+	// password "password"
+	testSHAHash = "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="
+)
+
+func writeHtpasswd(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		users   map[string]string
+		err     string
+	}{
+		{"bcrypt and sha", "bob:" + testBcryptHash + "\nalice:" + testSHAHash + "\n",
+			map[string]string{"bob": testBcryptHash, "alice": testSHAHash}, ""},
+		{"comments and blank lines", "# a comment\n\nbob:" + testBcryptHash + "\n",
+			map[string]string{"bob": testBcryptHash}, ""},
+		{"missing separator", "bob\n", nil, "line 1: expected user:hash"},
+		{"unsupported hash", "bob:$apr1$abc$def\n", nil, "line 1: unsupported hash for user bob, only bcrypt and {SHA} are supported"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, err := parseHtpasswd(bufio.NewScanner(strings.NewReader(test.content)))
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.users, users)
+		})
+	}
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	path := writeHtpasswd(t, t.TempDir(), "bob:"+testBcryptHash+"\nalice:"+testSHAHash+"\n")
+	h, err := newHtpasswdFile(path, time.Hour)
+	require.NoError(t, err)
+
+	assert.True(t, h.verify("bob", "secret=pass"))
+	assert.False(t, h.verify("bob", "secret"))
+	assert.True(t, h.verify("alice", "password"))
+	assert.False(t, h.verify("alice", "Password"))
+	assert.False(t, h.verify("carol", "password"))
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeHtpasswd(t, dir, "alice:"+testSHAHash+"\n")
+	h, err := newHtpasswdFile(path, 0)
+	require.NoError(t, err)
+
+	assert.True(t, h.verify("alice", "password"))
+	assert.False(t, h.verify("bob", "secret=pass"))
+
+	writeHtpasswd(t, dir, "bob:"+testBcryptHash+"\n")
+	// make sure the modification time moves even on coarse filesystems
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	assert.False(t, h.verify("alice", "password"))
+	assert.True(t, h.verify("bob", "secret=pass"))
+
+	// a broken file keeps the previous users
+	writeHtpasswd(t, dir, "broken\n")
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	assert.True(t, h.verify("bob", "secret=pass"))
+}
+
+func TestNewHtpasswdFileMissing(t *testing.T) {
+	_, err := newHtpasswdFile(filepath.Join(t.TempDir(), "missing"), time.Hour)
+	assert.Error(t, err)
+}
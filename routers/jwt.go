@@ -0,0 +1,377 @@
+package routers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// JWTConfig configures verification of signed JWTs sent as bearer tokens
+type JWTConfig struct {
+	// JWKSFile is a JSON Web Key Set used to look up keys by "kid"
+	JWKSFile string
+	// KeyFile is a single PEM encoded public key, or an HMAC secret
+	KeyFile       string
+	Issuer        string
+	Audience      string
+	IdentityClaim string
+	// ClaimLabels maps claims onto push labels, as "claim=label" pairs
+	ClaimLabels []string
+}
+
+func (cfg JWTConfig) enabled() bool {
+	return cfg.JWKSFile != "" || cfg.KeyFile != ""
+}
+
+var (
+	errJWTMalformed = errors.New("malformed jwt")
+	errJWTSignature = errors.New("invalid jwt signature")
+	errJWTExpired   = errors.New("jwt has expired")
+)
+
+// how far clocks are allowed to drift when checking exp and nbf
+const jwtLeeway = time.Minute
+
+type jwtVerifier struct {
+	// keys by "kid"; a static key is stored under the empty kid
+	keys map[string]interface{}
+	// jwks is set when keys were loaded from a JWKS, so tokens naming a kid
+	// must name one of them
+	jwks          bool
+	issuer        string
+	audience      string
+	identityClaim string
+	claimLabels   map[string]string
+	now           func() time.Time
+}
+
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		keys:          map[string]interface{}{},
+		issuer:        cfg.Issuer,
+		audience:      cfg.Audience,
+		identityClaim: cfg.IdentityClaim,
+		claimLabels:   map[string]string{},
+		now:           time.Now,
+	}
+	if v.identityClaim == "" {
+		v.identityClaim = "sub"
+	}
+
+	for _, item := range cfg.ClaimLabels {
+		claim, label, found := strings.Cut(item, "=")
+		if !found || claim == "" || !model.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("invalid jwt claim label mapping %q, expected claim=label", item)
+		}
+		v.claimLabels[claim] = label
+	}
+
+	if cfg.JWKSFile != "" {
+		if err := v.loadJWKS(cfg.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.KeyFile != "" {
+		key, err := loadStaticKey(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys[""] = key
+	}
+
+	return v, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func (v *jwtVerifier) loadJWKS(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return fmt.Errorf("%s: key %q: %w", path, jwk.Kid, err)
+		}
+		v.keys[jwk.Kid] = key
+	}
+	v.jwks = true
+	return nil
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	case "oct":
+		return decodeSegment(jwk.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// loadStaticKey reads a PEM encoded RSA or P-256 EC public key. Anything
+// that is not PEM is used as an HMAC secret.
+func loadStaticKey(path string) (interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(content)))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s: empty key", path)
+		}
+		return secret, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		// ES256 signatures are only defined over P-256
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: unsupported curve %s, expected P-256", path, k.Curve.Params().Name)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported public key type %T", path, key)
+}
+
+// looksLikeJWT tells JWTs apart from opaque API tokens
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+type jwtClaims map[string]interface{}
+
+// verify checks the signature and standard claims of a compact JWT
+func (v *jwtVerifier) verify(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSONSegment(parts[0], &header); err != nil {
+		return nil, errJWTMalformed
+	}
+
+	key, ok := v.keys[header.Kid]
+	if !ok && header.Kid != "" && !v.jwks {
+		// without a JWKS, the kid can't name any other key than the static one
+		key, ok = v.keys[""]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt key %q", header.Kid)
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJSONSegment(parts[1], &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJSONSegment(segment string, into interface{}) error {
+	raw, err := decodeSegment(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, into)
+}
+
+// verifySignature checks the signature with the algorithm from the header,
+// refusing any algorithm that doesn't match the type of key
+func verifySignature(alg string, key interface{}, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return errJWTSignature
+		}
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return errJWTSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errJWTSignature
+		}
+	case "HS256":
+		k, ok := key.([]byte)
+		if !ok {
+			return errJWTSignature
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errJWTSignature
+		}
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+	return nil
+}
+
+func (v *jwtVerifier) validateClaims(claims jwtClaims) error {
+	now := v.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("jwt has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("jwt is not valid yet")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("unexpected jwt issuer %v", claims["iss"])
+	}
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return errors.New("jwt is not intended for this audience")
+	}
+
+	if claims.stringClaim(v.identityClaim) == "" {
+		return fmt.Errorf("jwt is missing the %s claim", v.identityClaim)
+	}
+	return nil
+}
+
+func (c jwtClaims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stringClaim returns a string or numeric claim formatted as a string
+func (c jwtClaims) stringClaim(name string) string {
+	switch value := c[name].(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%v", value)
+	case bool:
+		return fmt.Sprintf("%t", value)
+	}
+	return ""
+}
+
+func (v *jwtVerifier) identity(claims jwtClaims) string {
+	return claims.stringClaim(v.identityClaim)
+}
+
+// labels returns the push labels mapped from the claims. Claims that are
+// missing or not scalar values are skipped.
+func (v *jwtVerifier) labels(claims jwtClaims) map[string]string {
+	labels := make(map[string]string, len(v.claimLabels))
+	for claim, label := range v.claimLabels {
+		if value := claims.stringClaim(claim); value != "" {
+			labels[label] = value
+		}
+	}
+	return labels
+}
@@ -0,0 +1,302 @@
+package routers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	raw, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeFile(t *testing.T, name string, content []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+	return path
+}
+
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa-1",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64([]byte{1, 0, 1}),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-1",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	}
+	raw, err := json.Marshal(set)
+	require.NoError(t, err)
+	return writeFile(t, "jwks.json", raw)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":    "user-1",
+		"iss":    "https://issuer",
+		"aud":    []string{"gateway", "other"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"tenant": "acme",
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	v, err := newJWTVerifier(JWTConfig{
+		JWKSFile:    writeJWKS(t, rsaKey, ecKey),
+		Issuer:      "https://issuer",
+		Audience:    "gateway",
+		ClaimLabels: []string{"tenant=tenant"},
+	})
+	require.NoError(t, err)
+
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa-1", rsaKey, validClaims()), ""},
+		{"ES256", signJWT(t, "ES256", "ec-1", ecKey, validClaims()), ""},
+		{"wrong key", signJWT(t, "RS256", "rsa-1", otherRSAKey, validClaims()), "invalid jwt signature"},
+		{"algorithm mismatch", signJWT(t, "ES256", "rsa-1", ecKey, validClaims()), "invalid jwt signature"},
+		{"unknown kid", signJWT(t, "RS256", "nope", rsaKey, validClaims()), `unknown jwt key "nope"`},
+		{"none algorithm", encodeSegment(t, map[string]string{"alg": "none", "kid": "rsa-1"}) + "." + encodeSegment(t, validClaims()) + ".", `unsupported jwt algorithm "none"`},
+		{"expired", signJWT(t, "RS256", "rsa-1", rsaKey, withClaim("exp", time.Now().Add(-time.Hour).Unix())), "jwt has expired"},
+		{"no expiry", signJWT(t, "RS256", "rsa-1", rsaKey, withClaim("exp", nil)), "jwt has no expiry"},
+		{"not yet valid", signJWT(t, "RS256", "rsa-1", rsaKey, withClaim("nbf", time.Now().Add(time.Hour).Unix())), "jwt is not valid yet"},
+		{"wrong issuer", signJWT(t, "RS256", "rsa-1", rsaKey, withClaim("iss", "https://evil")), "unexpected jwt issuer https://evil"},
+		{"wrong audience", signJWT(t, "RS256", "rsa-1", rsaKey, withClaim("aud", "other")), "jwt is not intended for this audience"},
+		{"missing identity", signJWT(t, "RS256", "rsa-1", rsaKey, withClaim("sub", nil)), "jwt is missing the sub claim"},
+		{"malformed", "a.b", "malformed jwt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := v.verify(test.token)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "user-1", v.identity(claims))
+			assert.Equal(t, map[string]string{"tenant": "acme"}, v.labels(claims))
+		})
+	}
+}
+
+func TestJWTStaticKeys(t *testing.T) {
+	t.Run("HMAC secret", func(t *testing.T) {
+		v, err := newJWTVerifier(JWTConfig{KeyFile: writeFile(t, "secret", []byte("top-secret\n"))})
+		require.NoError(t, err)
+
+		_, err = v.verify(signJWT(t, "HS256", "", []byte("top-secret"), validClaims()))
+		assert.NoError(t, err)
+		_, err = v.verify(signJWT(t, "HS256", "", []byte("guess"), validClaims()))
+		assert.EqualError(t, err, "invalid jwt signature")
+	})
+
+	t.Run("PEM public key", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		keyFile := writeFile(t, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+		v, err := newJWTVerifier(JWTConfig{KeyFile: keyFile})
+		require.NoError(t, err)
+
+		_, err = v.verify(signJWT(t, "ES256", "", key, validClaims()))
+		assert.NoError(t, err)
+		// an HMAC signed with the public key must not be accepted
+		_, err = v.verify(signJWT(t, "HS256", "", der, validClaims()))
+		assert.EqualError(t, err, "invalid jwt signature")
+	})
+
+	t.Run("PEM public key on another curve", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		keyFile := writeFile(t, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+		_, err = newJWTVerifier(JWTConfig{KeyFile: keyFile})
+		assert.EqualError(t, err, keyFile+": unsupported curve P-384, expected P-256")
+	})
+
+	t.Run("kid with only a static key", func(t *testing.T) {
+		v, err := newJWTVerifier(JWTConfig{KeyFile: writeFile(t, "secret", []byte("top-secret"))})
+		require.NoError(t, err)
+
+		_, err = v.verify(signJWT(t, "HS256", "any", []byte("top-secret"), validClaims()))
+		assert.NoError(t, err)
+	})
+
+	t.Run("kid missing from the JWKS", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		v, err := newJWTVerifier(JWTConfig{
+			JWKSFile: writeJWKS(t, rsaKey, ecKey),
+			KeyFile:  writeFile(t, "secret", []byte("top-secret")),
+		})
+		require.NoError(t, err)
+
+		// a kid the JWKS doesn't have isn't checked against the static key
+		_, err = v.verify(signJWT(t, "HS256", "nope", []byte("top-secret"), validClaims()))
+		assert.EqualError(t, err, `unknown jwt key "nope"`)
+		_, err = v.verify(signJWT(t, "HS256", "", []byte("top-secret"), validClaims()))
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid claim label mapping", func(t *testing.T) {
+		_, err := newJWTVerifier(JWTConfig{KeyFile: writeFile(t, "secret", []byte("s")), ClaimLabels: []string{"tenant=bad-label"}})
+		assert.Error(t, err)
+	})
+}
+
+func TestJWTRouter(t *testing.T) {
+	secret := []byte("top-secret")
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain: "*",
+		JWT: JWTConfig{
+			KeyFile:     writeFile(t, "secret", secret),
+			ClaimLabels: []string{"tenant=tenant"},
+		},
+	})
+
+	claims := validClaims()
+	claims["tenant"] = "acme"
+	token := signJWT(t, "HS256", "", secret, claims)
+
+	for _, test := range []struct {
+		method, path, token string
+		statusCode          int
+	}{
+		{"POST", "/metrics/tenant/spoofed", token, 202},
+		{"POST", "/metrics", "not-a-jwt", 401},
+		{"POST", "/metrics", signJWT(t, "HS256", "", []byte("guess"), claims), 401},
+		{"GET", "/metrics", token, 403},
+	} {
+		req, err := http.NewRequest(test.method, test.path, bytes.NewBufferString("page_views_total 1\n"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, test.statusCode, w.Code, "%s %s", test.method, test.path)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// the tenant label comes from the verified claim, not the path
+	assert.Equal(t, "# TYPE page_views_total untyped\npage_views_total{tenant=\"acme\"} 1\n", w.Body.String())
+}
+
+func TestJWTRouterBodyWins(t *testing.T) {
+	secret := []byte("top-secret")
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain:          "*",
+		LabelConflictPolicy: metrics.LabelConflictBodyWins,
+		JWT: JWTConfig{
+			KeyFile:     writeFile(t, "secret", secret),
+			ClaimLabels: []string{"tenant=tenant"},
+		},
+	})
+
+	claims := validClaims()
+	claims["tenant"] = "acme"
+
+	req, err := http.NewRequest("POST", "/metrics/job/web", bytes.NewBufferString("page_views_total{job=\"app\",tenant=\"spoofed\"} 1\n"))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, "HS256", "", secret, claims))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// series labels win over the path, but never over verified claims
+	assert.Equal(t, "# TYPE page_views_total untyped\npage_views_total{job=\"app\",tenant=\"acme\"} 1\n", w.Body.String())
+}
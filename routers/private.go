@@ -7,9 +7,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/zapier/prom-aggregation-gateway/config"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
 )
 
-func setupLifecycleRouter(promRegistry *prometheus.Registry) *gin.Engine {
+func setupLifecycleRouter(promRegistry *prometheus.Registry, agg *metrics.Aggregate) *gin.Engine {
 	r := gin.New()
 
 	metricsHandler := promhttp.InstrumentMetricHandler(
@@ -18,7 +19,7 @@ func setupLifecycleRouter(promRegistry *prometheus.Registry) *gin.Engine {
 	)
 
 	r.GET("/healthy", handleHealthCheck)
-	r.GET("/ready", handleHealthCheck)
+	r.GET("/ready", handleReady(agg))
 	r.GET("/metrics", convertHandler(metricsHandler))
 
 	return r
@@ -46,3 +47,26 @@ func handleHealthCheck(c *gin.Context) {
 		IsAlive:   true,
 	})
 }
+
+// ReadyResponse is the health response with details of the gateway's state
+type ReadyResponse struct {
+	HealthResponse
+	Memory metrics.MemoryUsage `json:"memory"`
+}
+
+// handleReady reports the memory used by stored series. The gateway stays
+// ready past its memory limits, as it keeps serving what it has stored.
+func handleReady(agg *metrics.Aggregate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.JSON(http.StatusOK, ReadyResponse{
+			HealthResponse: HealthResponse{
+				Name:      config.Name,
+				Version:   config.Version,
+				CommitSHA: config.CommitSHA,
+				IsAlive:   true,
+			},
+			Memory: agg.Memory(),
+		})
+	}
+}
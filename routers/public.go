@@ -1,6 +1,10 @@
 package routers
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	promMetrics "github.com/slok/go-http-metrics/metrics/prometheus"
@@ -12,10 +16,134 @@ import (
 type ApiRouterConfig struct {
 	CorsDomain   string
 	Accounts     []string
-	authAccounts gin.Accounts
+	HtpasswdFile string
+	TokensFile   string
+	JWT          JWTConfig
+	RateLimit    RateLimitConfig
+	PushLimits   metrics.PushLimits
+	// PartialPushes applies the valid families of a push and reports the
+	// rejected ones, rather than rejecting the whole push
+	PartialPushes bool
+	// TypeConflictPolicy decides what happens to a family pushed with a
+	// different type than the one stored
+	TypeConflictPolicy metrics.TypeConflictPolicy
+	// PutReplaces makes PUT replace the series carrying the labels in the
+	// path, instead of adding to them like POST
+	PutReplaces bool
+	// IdempotencyTTL is how long Idempotency-Key headers of pushes are
+	// remembered, up to IdempotencyMaxKeys of them. Zero disables them.
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+	// LabelConflictPolicy decides what happens to a label from the path
+	// that is also on a pushed series
+	LabelConflictPolicy metrics.LabelConflictPolicy
+	// QueryLabels are the labels pushes may set with query parameters, and
+	// HeaderLabels maps request headers to the labels they set
+	QueryLabels  []string
+	HeaderLabels map[string]string
+	// Enrichments add labels worked out by the server, such as the country
+	// of the client, to every pushed series
+	Enrichments metrics.Enrichments
+	// IngestQueueSize is the most pushes waiting to be merged by
+	// IngestWorkers. Zero merges pushes before answering them.
+	IngestQueueSize int
+	IngestWorkers   int
+	// MemorySoftLimit is the approximate bytes stored series may use before
+	// new series are rejected, and MemoryHardLimit before the least
+	// recently updated ones are evicted. Zero is unlimited.
+	MemorySoftLimit int64
+	MemoryHardLimit int64
+	// TrustedProxies are the IPs and CIDRs of proxies whose forwarding
+	// headers are used for the client IP. None are trusted by default.
+	TrustedProxies []string
+	authAccounts   gin.Accounts
+
+	// ReadAccounts and ReadHtpasswdFile are the basic auth users allowed to
+	// scrape GET /metrics, separate from the users allowed to push
+	ReadAccounts     []string
+	ReadHtpasswdFile string
+	// RequireReadAuth protects GET /metrics even when no read users are
+	// configured, so only tokens with the read scope can scrape
+	RequireReadAuth bool
+}
+
+func loadVerifiers(accounts gin.Accounts, htpasswdFile string) ([]credentialVerifier, error) {
+	var verifiers []credentialVerifier
+
+	if len(accounts) > 0 {
+		verifiers = append(verifiers, staticAccounts(accounts))
+	}
+
+	if htpasswdFile != "" {
+		htpasswd, err := newHtpasswdFile(htpasswdFile, defaultHtpasswdReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load htpasswd file: %w", err)
+		}
+		verifiers = append(verifiers, htpasswd)
+	}
+
+	return verifiers, nil
+}
+
+// authenticator builds an authenticator for pushes from the configured basic
+// auth users, API tokens and JWT keys
+func (cfg *ApiRouterConfig) authenticator() (*authenticator, error) {
+	auth := &authenticator{}
+
+	accounts, err := processAuthConfig(cfg.Accounts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.authAccounts = accounts
+	verifiers, err := loadVerifiers(cfg.authAccounts, cfg.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	auth.verifiers = verifiers
+
+	if cfg.TokensFile != "" {
+		tokens, err := loadTokenStore(cfg.TokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load tokens file: %w", err)
+		}
+		auth.tokens = tokens
+	}
+
+	if cfg.JWT.enabled() {
+		jwt, err := newJWTVerifier(cfg.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup jwt verification: %w", err)
+		}
+		auth.jwt = jwt
+	}
+
+	return auth, nil
 }
 
-func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig promMetrics.Config) *gin.Engine {
+// readAuthenticator builds the authenticator for GET /metrics, which shares
+// API tokens with pushes but has its own basic auth users. It returns nil
+// when reads don't need to be authenticated.
+func (cfg *ApiRouterConfig) readAuthenticator(pushAuth *authenticator) (*authenticator, error) {
+	accounts, err := processAuthConfig(cfg.ReadAccounts)
+	if err != nil {
+		return nil, fmt.Errorf("read %w", err)
+	}
+	verifiers, err := loadVerifiers(accounts, cfg.ReadHtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(verifiers) == 0 && !cfg.RequireReadAuth {
+		return nil, nil
+	}
+	if len(verifiers) == 0 && pushAuth.tokens == nil {
+		return nil, errors.New("read auth is required but no read users or tokens are configured")
+	}
+
+	return &authenticator{verifiers: verifiers, tokens: pushAuth.tokens}, nil
+}
+
+func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig promMetrics.Config) (*gin.Engine, error) {
 	corsConfig := cors.Config{}
 	if cfg.CorsDomain != "*" {
 		corsConfig.AllowOrigins = []string{cfg.CorsDomain}
@@ -23,7 +151,15 @@ func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig prom
 		corsConfig.AllowAllOrigins = true
 	}
 	corsHandler := cors.New(corsConfig)
-	cfg.authAccounts = processAuthConfig(cfg.Accounts)
+
+	auth, err := cfg.authenticator()
+	if err != nil {
+		return nil, err
+	}
+	readAuth, err := cfg.readAuthenticator(auth)
+	if err != nil {
+		return nil, err
+	}
 
 	metricsMiddleware := middleware.New(middleware.Config{
 		Recorder: promMetrics.NewRecorder(promConfig),
@@ -31,20 +167,55 @@ func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig prom
 
 	r := gin.New()
 	r.RedirectTrailingSlash = false
+	// gin trusts every proxy by default, which would let any client pick
+	// its IP with X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
 
 	// add metric middleware for NoRoute handler
 	r.NoRoute(mGin.Handler("noRoute", metricsMiddleware))
 
 	neededHandlers := []gin.HandlerFunc{corsHandler}
-	if len(cfg.Accounts) > 0 {
-		neededHandlers = append(neededHandlers, gin.BasicAuth(cfg.authAccounts))
+	if auth.enabled() {
+		neededHandlers = append(neededHandlers, auth.require(scopePush))
+	}
+	if cfg.RateLimit.enabled() {
+		// after auth, so clients can be limited by their identity
+		limiter, err := newRateLimiter(cfg.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		neededHandlers = append(neededHandlers, limiter.handler())
 	}
 
-	r.GET("/metrics",
+	readHandlers := []gin.HandlerFunc{corsHandler}
+	if readAuth != nil {
+		readHandlers = append(readHandlers, readAuth.require(scopeRead))
+	} else if auth.acceptsBearer() {
+		readHandlers = append(readHandlers, auth.optional(scopeRead))
+	}
+
+	getHandlers := []gin.HandlerFunc{
 		mGin.Handler("getMetrics", metricsMiddleware),
+	}
+	getHandlers = append(getHandlers, readHandlers...)
+	getHandlers = append(getHandlers, agg.HandleRender)
+
+	r.GET("/metrics", getHandlers...)
+
+	// conflicts name the families every client pushed, so they are only
+	// listed to those allowed to push, limited to the families they may push
+	conflictHandlers := []gin.HandlerFunc{
+		mGin.Handler("getTypeConflicts", metricsMiddleware),
 		corsHandler,
-		agg.HandleRender,
-	)
+	}
+	if auth.enabled() {
+		conflictHandlers = append(conflictHandlers, auth.require(scopePush))
+	}
+	conflictHandlers = append(conflictHandlers, agg.HandleTypeConflicts)
+
+	r.GET("/admin/conflicts", conflictHandlers...)
 
 	postHandlers := []gin.HandlerFunc{
 		mGin.Handler("postMetrics", metricsMiddleware),
@@ -57,5 +228,20 @@ func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig prom
 	r.PUT("/metrics", postHandlers...)
 	r.PUT("/metrics/*labels", postHandlers...)
 
-	return r
+	// deletes can wipe every stored series, so they are only served when
+	// pushes are authenticated
+	if auth.enabled() {
+		deleteHandlers := []gin.HandlerFunc{
+			mGin.Handler("deleteMetrics", metricsMiddleware),
+			corsHandler,
+			auth.require(scopeDelete),
+			agg.HandleDelete,
+		}
+
+		// also serves DELETE /metrics/family/<name>, as gin can't route it
+		// separately from the catch-all
+		r.DELETE("/metrics/*labels", deleteHandlers...)
+	}
+
+	return r, nil
 }
@@ -0,0 +1,223 @@
+package routers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+const (
+	rateLimitByIP       = "ip"
+	rateLimitByIdentity = "identity"
+	rateLimitByJob      = "job"
+
+	// buckets that have been idle this long are forgotten
+	rateLimitIdleTimeout = 10 * time.Minute
+)
+
+// RateLimitConfig limits how often each client may push
+type RateLimitConfig struct {
+	// Key is what clients are told apart by: ip, identity or job
+	Key string
+	// Rate is the number of pushes per second allowed per client, 0 disables
+	// rate limiting for clients without an override
+	Rate  float64
+	Burst int
+	// Overrides are per client limits as "key=rate" or "key=rate:burst"
+	Overrides []string
+}
+
+func (cfg RateLimitConfig) enabled() bool {
+	return cfg.Rate > 0 || len(cfg.Overrides) > 0
+}
+
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+func (l rateLimit) unlimited() bool {
+	return l.rate <= 0
+}
+
+func newRateLimit(rate float64, burst int) rateLimit {
+	if burst < 1 {
+		// always allow at least one push, or nothing would ever get through
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return rateLimit{rate: rate, burst: float64(burst)}
+}
+
+func parseRateLimitOverride(item string) (string, rateLimit, error) {
+	key, value, found := strings.Cut(item, "=")
+	if !found || key == "" {
+		return "", rateLimit{}, fmt.Errorf("invalid rate limit override %q, expected key=rate[:burst]", item)
+	}
+
+	rateString, burstString, hasBurst := strings.Cut(value, ":")
+	rate, err := strconv.ParseFloat(rateString, 64)
+	if err != nil || rate < 0 {
+		return "", rateLimit{}, fmt.Errorf("invalid rate in rate limit override %q", item)
+	}
+
+	burst := 0
+	if hasBurst {
+		burst, err = strconv.Atoi(burstString)
+		if err != nil || burst < 1 {
+			return "", rateLimit{}, fmt.Errorf("invalid burst in rate limit override %q", item)
+		}
+	}
+
+	return key, newRateLimit(rate, burst), nil
+}
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket, or says how long until one is
+// available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(b.limit.burst, b.tokens+elapsed*b.limit.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / b.limit.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+type rateLimiter struct {
+	key          string
+	defaultLimit rateLimit
+	overrides    map[string]rateLimit
+	now          func() time.Time
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) (*rateLimiter, error) {
+	rl := &rateLimiter{
+		key:          cfg.Key,
+		defaultLimit: newRateLimit(cfg.Rate, cfg.Burst),
+		overrides:    map[string]rateLimit{},
+		buckets:      map[string]*tokenBucket{},
+		now:          time.Now,
+	}
+
+	switch rl.key {
+	case "":
+		rl.key = rateLimitByIP
+	case rateLimitByIP, rateLimitByIdentity, rateLimitByJob:
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q, expected one of ip, identity or job", cfg.Key)
+	}
+
+	for _, item := range cfg.Overrides {
+		key, limit, err := parseRateLimitOverride(item)
+		if err != nil {
+			return nil, err
+		}
+		rl.overrides[key] = limit
+	}
+
+	rl.lastSweep = rl.now()
+	return rl, nil
+}
+
+// clientKey identifies the client of a request. Requests without an
+// identity or job are told apart by IP, which only comes from forwarding
+// headers when the request is from a trusted proxy, so clients can't get a
+// fresh bucket by sending their own X-Forwarded-For.
+func (rl *rateLimiter) clientKey(c *gin.Context) string {
+	switch rl.key {
+	case rateLimitByIdentity:
+		if identity := c.GetString(gin.AuthUserKey); identity != "" {
+			return identity
+		}
+	case rateLimitByJob:
+		if job := metrics.JobName(c); job != "" {
+			return job
+		}
+	}
+	return c.ClientIP()
+}
+
+func (rl *rateLimiter) allow(key string) (bool, time.Duration, string) {
+	limit, overridden := rl.overrides[key]
+	limitName := "override"
+	if !overridden {
+		limit = rl.defaultLimit
+		limitName = "default"
+	}
+	if limit.unlimited() {
+		return true, 0, limitName
+	}
+
+	now := rl.now()
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	rl.sweep(now)
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{limit: limit, tokens: limit.burst, last: now}
+		rl.buckets[key] = bucket
+		metrics.RateLimitClients.Set(float64(len(rl.buckets)))
+	}
+
+	allowed, retryAfter := bucket.take(now)
+	return allowed, retryAfter, limitName
+}
+
+// sweep drops idle buckets so clients that went away don't use memory
+// forever. It must be called with the lock held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitIdleTimeout {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= rateLimitIdleTimeout {
+			delete(rl.buckets, key)
+		}
+	}
+	metrics.RateLimitClients.Set(float64(len(rl.buckets)))
+}
+
+func (rl *rateLimiter) handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, retryAfter, limitName := rl.allow(rl.clientKey(c))
+		if allowed {
+			c.Next()
+			return
+		}
+
+		metrics.RateLimitedPushes.WithLabelValues(limitName).Inc()
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.String(http.StatusTooManyRequests, "rate limit exceeded, retry in %ds", seconds)
+		c.Abort()
+	}
+}
@@ -0,0 +1,178 @@
+package routers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimitOverride(t *testing.T) {
+	tests := []struct {
+		item  string
+		key   string
+		limit rateLimit
+		err   bool
+	}{
+		{"ci=10", "ci", rateLimit{rate: 10, burst: 10}, false},
+		{"ci=0.5", "ci", rateLimit{rate: 0.5, burst: 1}, false},
+		{"ci=2:20", "ci", rateLimit{rate: 2, burst: 20}, false},
+		{"ci=0", "ci", rateLimit{rate: 0, burst: 1}, false},
+		{"ci", "", rateLimit{}, true},
+		{"=1", "", rateLimit{}, true},
+		{"ci=fast", "", rateLimit{}, true},
+		{"ci=1:0", "", rateLimit{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.item, func(t *testing.T) {
+			key, limit, err := parseRateLimitOverride(test.item)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.key, key)
+			assert.Equal(t, test.limit, limit)
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 2, Overrides: []string{"fast=0", "slow=0.1"}})
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	rl.now = func() time.Time { return now }
+	rl.lastSweep = now
+
+	allowed, _, _ := rl.allow("client")
+	assert.True(t, allowed)
+	allowed, _, _ = rl.allow("client")
+	assert.True(t, allowed)
+	allowed, retryAfter, limit := rl.allow("client")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+	assert.Equal(t, "default", limit)
+
+	// other clients have their own bucket
+	allowed, _, _ = rl.allow("other")
+	assert.True(t, allowed)
+
+	now = now.Add(time.Second)
+	allowed, _, _ = rl.allow("client")
+	assert.True(t, allowed)
+
+	for i := 0; i < 100; i++ {
+		allowed, _, _ = rl.allow("fast")
+		require.True(t, allowed)
+	}
+
+	allowed, _, _ = rl.allow("slow")
+	assert.True(t, allowed)
+	allowed, retryAfter, limit = rl.allow("slow")
+	assert.False(t, allowed)
+	assert.Equal(t, 10*time.Second, retryAfter)
+	assert.Equal(t, "override", limit)
+
+	now = now.Add(rateLimitIdleTimeout)
+	rl.allow("client")
+	assert.Len(t, rl.buckets, 1)
+}
+
+func TestNewRateLimiterInvalidKey(t *testing.T) {
+	_, err := newRateLimiter(RateLimitConfig{Key: "path", Rate: 1})
+	assert.Error(t, err)
+}
+
+func TestRateLimitRouter(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        RateLimitConfig
+		paths      []string
+		users      []string
+		statusCode []int
+	}{
+		{
+			"by ip",
+			RateLimitConfig{Rate: 1},
+			[]string{"/metrics/job/a", "/metrics/job/b"},
+			[]string{"user", "user"},
+			[]int{202, 429},
+		},
+		{
+			"by job",
+			RateLimitConfig{Key: "job", Rate: 1},
+			[]string{"/metrics/job/a", "/metrics/job/b", "/metrics/job/a"},
+			[]string{"user", "user", "user"},
+			[]int{202, 202, 429},
+		},
+		{
+			"by identity with override",
+			RateLimitConfig{Key: "identity", Rate: 1, Overrides: []string{"admin=0"}},
+			[]string{"/metrics", "/metrics", "/metrics", "/metrics"},
+			[]string{"admin", "admin", "user", "user"},
+			[]int{202, 202, 202, 429},
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{
+				CorsDomain: "*",
+				Accounts:   []string{"user=pass", "admin=pass"},
+				RateLimit:  test.cfg,
+			})
+
+			for i, path := range test.paths {
+				req, err := http.NewRequest("POST", path, bytes.NewBufferString("some_counter 1\n"))
+				require.NoError(t, err)
+				req.SetBasicAuth(test.users[i], "pass")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, test.statusCode[i], w.Code, "request #%d", i+1)
+				if w.Code == http.StatusTooManyRequests {
+					assert.Equal(t, "1", w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		statusCode     []int
+	}{
+		{"spoofed headers are ignored", nil, []int{202, 429, 429}},
+		{"trusted proxy forwards the client", []string{"192.0.2.1"}, []int{202, 202, 202}},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{
+				CorsDomain:     "*",
+				RateLimit:      RateLimitConfig{Rate: 1},
+				TrustedProxies: test.trustedProxies,
+			})
+
+			for i, code := range test.statusCode {
+				// every request comes from 192.0.2.1, claiming to be another client
+				req := httptest.NewRequest("POST", "/metrics/job/a", bytes.NewBufferString("some_counter 1\n"))
+				req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i+1))
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				assert.Equal(t, code, w.Code, "request #%d", i+1)
+			}
+		})
+	}
+}
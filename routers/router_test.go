@@ -2,12 +2,15 @@ package routers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,11 +21,26 @@ import (
 )
 
 func setupTestRouter(cfg ApiRouterConfig) *gin.Engine {
-	agg := metrics.NewAggregate()
+	agg := metrics.NewAggregate(
+		metrics.SetPushLimits(cfg.PushLimits),
+		metrics.SetPartialPushes(cfg.PartialPushes),
+		metrics.SetTypeConflictPolicy(cfg.TypeConflictPolicy),
+		metrics.SetPutReplaces(cfg.PutReplaces),
+		metrics.SetIdempotency(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys),
+		metrics.SetLabelConflictPolicy(cfg.LabelConflictPolicy),
+		metrics.SetRequestLabels(cfg.QueryLabels, cfg.HeaderLabels),
+		metrics.SetEnrichments(cfg.Enrichments),
+		metrics.SetIngestQueue(cfg.IngestQueueSize, cfg.IngestWorkers),
+		metrics.SetMemoryBudget(cfg.MemorySoftLimit, cfg.MemoryHardLimit),
+	)
 	promConfig := promMetrics.Config{
 		Registry: prometheus.NewRegistry(),
 	}
-	return setupAPIRouter(cfg, agg, promConfig)
+	r, err := setupAPIRouter(cfg, agg, promConfig)
+	if err != nil {
+		panic(err)
+	}
+	return r
 }
 
 func TestHealthCheck(t *testing.T) {
@@ -82,6 +100,18 @@ some_counter{job="someJob"} 1
 			"# TYPE some_counter counter\nsome_counter 1\n",
 			"# TYPE some_counter counter\nsome_counter 1\n",
 		},
+		{
+			"base64 label values",
+			"/metrics/job@base64/L3Zhci9sb2cvYXBw/url@base64/aHR0cHM6Ly9leGFtcGxlLmNvbS9hP2I9Yw==",
+			"# TYPE some_counter counter\nsome_counter 1\n",
+			"# TYPE some_counter counter\nsome_counter{job=\"/var/log/app\",url=\"https://example.com/a?b=c\"} 1\n",
+		},
+		{
+			"empty base64 label value",
+			"/metrics/job/someJob/instance@base64/=",
+			"# TYPE some_counter counter\nsome_counter 1\n",
+			"# TYPE some_counter counter\nsome_counter{instance=\"\",job=\"someJob\"} 1\n",
+		},
 		{
 			"duplicate labels",
 			"/metrics/testing/one/testing/two/testing/three",
@@ -182,6 +212,1128 @@ func TestAuthRouter(t *testing.T) {
 	}
 }
 
+func TestHtpasswdRouter(t *testing.T) {
+	path := writeHtpasswd(t, t.TempDir(), "alice:"+testSHAHash+"\n")
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "https://cors-domain", HtpasswdFile: path})
+
+	for _, test := range []struct {
+		user, password string
+		statusCode     int
+	}{
+		{"alice", "password", 202},
+		{"alice", "wrong", 401},
+	} {
+		buf := bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 1\n")
+		req, err := http.NewRequest("POST", "/metrics", buf)
+		require.NoError(t, err)
+		req.SetBasicAuth(test.user, test.password)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, test.statusCode, w.Code)
+	}
+}
+
+func TestTokenRouter(t *testing.T) {
+	tests := []struct {
+		name          string
+		method, path  string
+		metric        string
+		header, token string
+		statusCode    int
+	}{
+		{"push allowed", "POST", "/metrics/job/ci", "ci_runs_total 1\n", "Authorization", "Bearer ci-secret", 202},
+		{"push with api key", "POST", "/metrics/job/ci", "ci_runs_total 1\n", "X-API-Key", "ci-secret", 202},
+		{"unknown token", "POST", "/metrics/job/ci", "ci_runs_total 1\n", "Authorization", "Bearer nope", 401},
+		{"no credentials", "POST", "/metrics/job/ci", "ci_runs_total 1\n", "", "", 401},
+		{"push without scope", "POST", "/metrics/job/ci", "ci_runs_total 1\n", "Authorization", "Bearer scrape-secret", 403},
+		{"job not allowed", "POST", "/metrics/job/other", "ci_runs_total 1\n", "Authorization", "Bearer ci-secret", 403},
+		{"metric not allowed", "POST", "/metrics/job/ci", "ci_runs_total 1\nhttp_requests_total 1\n", "Authorization", "Bearer ci-secret", 403},
+		{"read allowed", "GET", "/metrics", "", "Authorization", "Bearer scrape-secret", 200},
+		{"read without scope", "GET", "/metrics", "", "Authorization", "Bearer ci-secret", 403},
+		{"anonymous read", "GET", "/metrics", "", "", "", 200},
+	}
+
+	tokensFile := writeTokens(t, testTokensFile)
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", TokensFile: tokensFile})
+
+			req, err := http.NewRequest(test.method, test.path, bytes.NewBufferString(test.metric))
+			require.NoError(t, err)
+			if test.header != "" {
+				req.Header.Set(test.header, test.token)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Code)
+		})
+	}
+
+	t.Run("read is limited to metric prefixes", func(t *testing.T) {
+		router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", TokensFile: writeTokens(t, `
+tokens:
+  - name: admin
+    token: admin-secret
+    scopes: [push]
+  - name: reader
+    token: read-secret
+    scopes: [read]
+    metricPrefixes: [ci_]
+`)})
+
+		req, err := http.NewRequest("POST", "/metrics", bytes.NewBufferString("ci_runs_total 1\nhttp_requests_total 1\n"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+
+		req, err = http.NewRequest("GET", "/metrics", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer read-secret")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "# TYPE ci_runs_total untyped\nci_runs_total 1\n", w.Body.String())
+	})
+}
+
+func TestReadAuthRouter(t *testing.T) {
+	tokensFile := writeTokens(t, testTokensFile)
+	tests := []struct {
+		name       string
+		cfg        ApiRouterConfig
+		method     string
+		setAuth    func(req *http.Request)
+		statusCode int
+	}{
+		{
+			"read user can scrape",
+			ApiRouterConfig{Accounts: []string{"pusher=push"}, ReadAccounts: []string{"prometheus=scrape"}},
+			"GET", func(req *http.Request) { req.SetBasicAuth("prometheus", "scrape") }, 200,
+		},
+		{
+			"anonymous scrape is rejected",
+			ApiRouterConfig{Accounts: []string{"pusher=push"}, ReadAccounts: []string{"prometheus=scrape"}},
+			"GET", func(req *http.Request) {}, 401,
+		},
+		{
+			"push user can not scrape",
+			ApiRouterConfig{Accounts: []string{"pusher=push"}, ReadAccounts: []string{"prometheus=scrape"}},
+			"GET", func(req *http.Request) { req.SetBasicAuth("pusher", "push") }, 401,
+		},
+		{
+			"read user can not push",
+			ApiRouterConfig{Accounts: []string{"pusher=push"}, ReadAccounts: []string{"prometheus=scrape"}},
+			"POST", func(req *http.Request) { req.SetBasicAuth("prometheus", "scrape") }, 401,
+		},
+		{
+			"required read auth accepts read tokens",
+			ApiRouterConfig{TokensFile: tokensFile, RequireReadAuth: true},
+			"GET", func(req *http.Request) { req.Header.Set("Authorization", "Bearer scrape-secret") }, 200,
+		},
+		{
+			"required read auth rejects anonymous scrapes",
+			ApiRouterConfig{TokensFile: tokensFile, RequireReadAuth: true},
+			"GET", func(req *http.Request) {}, 401,
+		},
+		{
+			"required read auth rejects push tokens",
+			ApiRouterConfig{TokensFile: tokensFile, RequireReadAuth: true},
+			"GET", func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-secret") }, 403,
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			test.cfg.CorsDomain = "*"
+			router := setupTestRouter(test.cfg)
+
+			req, err := http.NewRequest(test.method, "/metrics", bytes.NewBufferString("some_counter 1\n"))
+			require.NoError(t, err)
+			test.setAuth(req)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Code)
+		})
+	}
+
+	t.Run("required read auth without credentials", func(t *testing.T) {
+		_, err := setupAPIRouter(ApiRouterConfig{CorsDomain: "*", RequireReadAuth: true}, metrics.NewAggregate(), promMetrics.Config{Registry: prometheus.NewRegistry()})
+		assert.Error(t, err)
+	})
+}
+
+func TestPushLimitsRouter(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     metrics.PushLimits
+		path, body string
+		statusCode int
+		expected   string
+	}{
+		{
+			"within limits",
+			metrics.PushLimits{MaxBodyBytes: 1024, MaxFamilies: 2, MaxSeries: 2, MaxLabels: 2, MaxLabelValueLength: 5},
+			"/metrics/job/test", "a{x=\"1\"} 1\nb 1\n",
+			202, "",
+		},
+		{
+			"body too large",
+			metrics.PushLimits{MaxBodyBytes: 10},
+			"/metrics", "some_counter 1\nother_counter 1\n",
+			413, "push limit exceeded: request body is larger than 10 bytes\n",
+		},
+		{
+			"too many families",
+			metrics.PushLimits{MaxFamilies: 1},
+			"/metrics", "a 1\nb 1\n",
+			400, "push limit exceeded: 2 metric families in push, the limit is 1\n",
+		},
+		{
+			"too many series",
+			metrics.PushLimits{MaxSeries: 2},
+			"/metrics", "a{x=\"1\"} 1\na{x=\"2\"} 1\nb 1\n",
+			400, "push limit exceeded: more than 2 series in push\n",
+		},
+		{
+			"too many labels",
+			metrics.PushLimits{MaxLabels: 2},
+			"/metrics/job/test", "a{x=\"1\",y=\"2\"} 1\n",
+			400, "push limit exceeded: series of metric a has 3 labels, the limit is 2\n",
+		},
+		{
+			"label value too long",
+			metrics.PushLimits{MaxLabelValueLength: 5},
+			"/metrics", "a{path=\"/a/long/path\"} 1\n",
+			400, "push limit exceeded: value of label path on metric a is 12 bytes long, the limit is 5\n",
+		},
+		{
+			"path label value too long",
+			metrics.PushLimits{MaxLabelValueLength: 5},
+			"/metrics/job/a-long-job", "a 1\n",
+			400, "push limit exceeded: value of path label job is 10 bytes long, the limit is 5\n",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", PushLimits: test.limits})
+
+			req, err := http.NewRequest("POST", test.path, bytes.NewBufferString(test.body))
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Code)
+			assert.Equal(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+func TestCompressionRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+	metric := "# TYPE some_counter counter\nsome_counter 1\n"
+
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	_, err := gz.Write([]byte(metric))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	req, err := http.NewRequest("POST", "/metrics", compressed)
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	req, err = http.NewRequest("POST", "/metrics", bytes.NewBufferString(metric))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "br")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 415, w.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gzr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gzr)
+	require.NoError(t, err)
+	assert.Equal(t, metric, string(body))
+}
+
+func TestPartialPushRouter(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        ApiRouterConfig
+		path       string
+		statusCode int
+		expected   string
+	}{
+		{
+			"atomic by default",
+			ApiRouterConfig{},
+			"/metrics",
+			400,
+			"",
+		},
+		{
+			"partial by query",
+			ApiRouterConfig{},
+			"/metrics?partial=true",
+			202,
+			"# TYPE good counter\ngood 1\n",
+		},
+		{
+			"partial by default",
+			ApiRouterConfig{PartialPushes: true},
+			"/metrics",
+			202,
+			"# TYPE good counter\ngood 1\n",
+		},
+		{
+			"atomic by query",
+			ApiRouterConfig{PartialPushes: true},
+			"/metrics?partial=false",
+			400,
+			"",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			test.cfg.CorsDomain = "*"
+			router := setupTestRouter(test.cfg)
+
+			body := "# TYPE good counter\ngood 1\n# TYPE bad counter\nbad 1\nbad 2\n"
+			req, err := http.NewRequest("POST", test.path, bytes.NewBufferString(body))
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.statusCode, w.Code)
+
+			if test.statusCode == 202 {
+				assert.JSONEq(t, `{"accepted":["good"],"rejected":[{"family":"bad","line":3,"category":"duplicate_labels","error":"duplicate labels: {__name__=\"bad\"}"}]}`, w.Body.String())
+			}
+
+			req, err = http.NewRequest("GET", "/metrics", nil)
+			require.NoError(t, err)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+func TestPushErrorsRouter(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		accept     string
+		statusCode int
+		expected   string
+	}{
+		{
+			"parse error as text",
+			"some_counter{ 1\n",
+			"",
+			400,
+			"text format parsing error in line 1: invalid label name for metric \"some_counter\"\n",
+		},
+		{
+			"parse error as json",
+			"ok 1\nsome_counter{ 1\n",
+			"application/json",
+			400,
+			`{"error":"Bad Request","errors":[{"line":2,"category":"parse","error":"text format parsing error in line 2: invalid label name for metric \"some_counter\""}]}`,
+		},
+		{
+			"every failing family as json",
+			"# TYPE stored gauge\nstored 1\n# TYPE dupe counter\ndupe 1\ndupe 2\n",
+			"text/plain, application/json;q=0.9",
+			400,
+			`{"error":"Bad Request","errors":[` +
+				`{"family":"dupe","line":3,"category":"duplicate_labels","error":"duplicate labels: {__name__=\"dupe\"}"},` +
+				`{"family":"stored","line":1,"category":"type_conflict","error":"cannot merge metric 'stored': type COUNTER != GAUGE"}]}`,
+		},
+		{
+			"every failing family as text",
+			"# TYPE stored gauge\nstored 1\n# TYPE dupe counter\ndupe 1\ndupe 2\n",
+			"text/plain",
+			400,
+			"duplicate labels: {__name__=\"dupe\"}\ncannot merge metric 'stored': type COUNTER != GAUGE\n",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+
+			req, err := http.NewRequest("POST", "/metrics", bytes.NewBufferString("# TYPE stored counter\nstored 1\n"))
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, 202, w.Code)
+
+			req, err = http.NewRequest("POST", "/metrics", bytes.NewBufferString(test.body))
+			require.NoError(t, err)
+			req.Header.Set("Accept", test.accept)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Code)
+			if strings.Contains(test.accept, "json") {
+				assert.JSONEq(t, test.expected, w.Body.String())
+			} else {
+				assert.Equal(t, test.expected, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTypeConflictRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain:         "*",
+		TypeConflictPolicy: metrics.TypeConflictKeepBoth,
+		TokensFile:         writeTokens(t, testTokensFile),
+	})
+
+	for _, body := range []string{"# TYPE a counter\na 1\n", "# TYPE a gauge\na 2\n"} {
+		req, err := http.NewRequest("POST", "/metrics", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+	}
+
+	for idx, test := range []struct {
+		name, authorization string
+		statusCode          int
+		conflicts           int
+	}{
+		{"no auth", "", 401, 0},
+		// conflicts are only listed to clients that may push
+		{"read token", "Bearer scrape-secret", 403, 0},
+		// and only for the families they may push
+		{"prefixed token", "Bearer ci-secret", 200, 0},
+		{"admin token", "Bearer admin-secret", 200, 1},
+	} {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/admin/conflicts", nil)
+			require.NoError(t, err)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, test.statusCode, w.Code)
+			if w.Code != 200 {
+				return
+			}
+
+			var response struct {
+				Policy    string                 `json:"policy"`
+				Conflicts []metrics.TypeConflict `json:"conflicts"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "keep_both", response.Policy)
+			require.Len(t, response.Conflicts, test.conflicts)
+			if test.conflicts == 0 {
+				return
+			}
+			assert.Equal(t, "a", response.Conflicts[0].Family)
+			assert.Equal(t, "COUNTER", response.Conflicts[0].StoredType)
+			assert.Equal(t, "GAUGE", response.Conflicts[0].PushedType)
+			assert.Equal(t, "a_gauge", response.Conflicts[0].StoredAs)
+		})
+	}
+}
+
+func TestDeleteRouter(t *testing.T) {
+	const pushed = "# TYPE ci_runs_total counter\nci_runs_total{instance=\"1\"} 1\nci_runs_total{instance=\"2\"} 2\n# TYPE http_requests_total counter\nhttp_requests_total 3\n"
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		statusCode int
+		body       string
+		expected   string
+	}{
+		{
+			"by job",
+			"/metrics/job/ci",
+			"admin-secret",
+			202,
+			`{"families":1,"series":3}`,
+			"# TYPE http_requests_total counter\nhttp_requests_total{job=\"other\"} 3\n",
+		},
+		{
+			"by job and label",
+			"/metrics/job/ci/instance/1",
+			"admin-secret",
+			202,
+			`{"families":0,"series":1}`,
+			"# TYPE ci_runs_total counter\nci_runs_total{instance=\"2\",job=\"ci\"} 2\n# TYPE http_requests_total counter\nhttp_requests_total{job=\"ci\"} 3\nhttp_requests_total{job=\"other\"} 3\n",
+		},
+		{
+			"family",
+			"/metrics/family/http_requests_total",
+			"admin-secret",
+			202,
+			`{"families":1,"series":2}`,
+			"# TYPE ci_runs_total counter\nci_runs_total{instance=\"1\",job=\"ci\"} 1\nci_runs_total{instance=\"2\",job=\"ci\"} 2\n",
+		},
+		{
+			"unknown family",
+			"/metrics/family/nope",
+			"admin-secret",
+			404,
+			`{"error":"metric \"nope\" not found"}`,
+			"",
+		},
+		{
+			"no labels",
+			"/metrics/",
+			"admin-secret",
+			400,
+			"labels to delete series by are required\n",
+			"",
+		},
+		{
+			"odd labels",
+			"/metrics/job",
+			"admin-secret",
+			400,
+			"labels must be defined in pairs\n",
+			"",
+		},
+		{
+			"without scope",
+			"/metrics/job/ci",
+			"ci-secret",
+			403,
+			"token ci does not have the delete scope",
+			"",
+		},
+		{
+			"no credentials",
+			"/metrics/job/ci",
+			"",
+			401,
+			"",
+			"",
+		},
+	}
+
+	tokensFile := writeTokens(t, testTokensFile)
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", TokensFile: tokensFile})
+
+			for _, path := range []string{"/metrics/job/ci", "/metrics/job/other"} {
+				body := pushed
+				if path == "/metrics/job/other" {
+					body = "# TYPE http_requests_total counter\nhttp_requests_total 3\n"
+				}
+				req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+				require.NoError(t, err)
+				req.Header.Set("Authorization", "Bearer admin-secret")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				require.Equal(t, 202, w.Code)
+			}
+
+			req, err := http.NewRequest("DELETE", test.path, nil)
+			require.NoError(t, err)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Code)
+			if test.statusCode == 202 || test.statusCode == 404 {
+				assert.JSONEq(t, test.body, w.Body.String())
+			} else {
+				assert.Equal(t, test.body, w.Body.String())
+			}
+			if test.expected == "" {
+				return
+			}
+
+			req, err = http.NewRequest("GET", "/metrics", nil)
+			require.NoError(t, err)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+func TestDeleteFamilyJobPolicyRouter(t *testing.T) {
+	tokensFile := writeTokens(t, testTokensFile+`  - name: ci-cleanup
+    token: cleanup-secret
+    scopes: [push, delete]
+    jobs: [ci]
+`)
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", TokensFile: tokensFile})
+
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	for _, job := range []string{"ci", "other"} {
+		w := request("POST", "/metrics/job/"+job, "admin-secret", "# TYPE shared_total counter\nshared_total 1\n")
+		require.Equal(t, 202, w.Code)
+	}
+
+	// the family is shared with another job, so only the series of the
+	// token's own job are deleted
+	w := request("DELETE", "/metrics/family/shared_total", "cleanup-secret", "")
+	assert.Equal(t, 202, w.Code)
+	assert.JSONEq(t, `{"families":0,"series":1}`, w.Body.String())
+
+	w = request("GET", "/metrics", "admin-secret", "")
+	assert.Equal(t, "# TYPE shared_total counter\nshared_total{job=\"other\"} 1\n", w.Body.String())
+
+	w = request("DELETE", "/metrics/family/shared_total", "admin-secret", "")
+	assert.Equal(t, 202, w.Code)
+	assert.JSONEq(t, `{"families":1,"series":1}`, w.Body.String())
+}
+
+func TestPutReplacesPolicyRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", TokensFile: writeTokens(t, testTokensFile), PutReplaces: true})
+
+	push := func(method, token, body string) {
+		req, err := http.NewRequest(method, "/metrics/job/ci", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+	}
+	push("POST", "admin-secret", "# TYPE ci_runs_total counter\nci_runs_total{instance=\"1\"} 1\n# TYPE http_requests_total counter\nhttp_requests_total 1\n")
+
+	// the ci token may only push ci_ and build_ metrics, so its replace
+	// leaves the other families of the job alone
+	push("PUT", "ci-secret", "# TYPE ci_runs_total counter\nci_runs_total{instance=\"2\"} 1\n")
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "# TYPE ci_runs_total counter\nci_runs_total{instance=\"2\",job=\"ci\"} 1\n# TYPE http_requests_total counter\nhttp_requests_total{job=\"ci\"} 1\n", w.Body.String())
+}
+
+func TestDeleteWithoutAuthRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+
+	req, err := http.NewRequest("POST", "/metrics/job/ci", bytes.NewBufferString("# TYPE ci_runs_total counter\nci_runs_total 1\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	// without push auth anyone could wipe the gateway, so deletes aren't
+	// served at all
+	for _, path := range []string{"/metrics/job/ci", "/metrics/family/ci_runs_total"} {
+		req, err := http.NewRequest("DELETE", path, nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 404, w.Code, path)
+	}
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "# TYPE ci_runs_total counter\nci_runs_total{job=\"ci\"} 1\n", w.Body.String())
+}
+
+func TestPutReplacesRouter(t *testing.T) {
+	tests := []struct {
+		name        string
+		putReplaces bool
+		method      string
+		path        string
+		statusCode  int
+		expected    string
+	}{
+		{
+			"put adds by default",
+			false,
+			"PUT",
+			"/metrics/job/ci",
+			202,
+			"# TYPE runs counter\nruns{instance=\"1\",job=\"ci\"} 2\nruns{instance=\"2\",job=\"ci\"} 1\nruns{job=\"other\"} 1\n",
+		},
+		{
+			"put replaces the group",
+			true,
+			"PUT",
+			"/metrics/job/ci",
+			202,
+			"# TYPE runs counter\nruns{instance=\"1\",job=\"ci\"} 1\nruns{job=\"other\"} 1\n",
+		},
+		{
+			"post still adds",
+			true,
+			"POST",
+			"/metrics/job/ci",
+			202,
+			"# TYPE runs counter\nruns{instance=\"1\",job=\"ci\"} 2\nruns{instance=\"2\",job=\"ci\"} 1\nruns{job=\"other\"} 1\n",
+		},
+		{
+			"put needs labels",
+			true,
+			"PUT",
+			"/metrics",
+			400,
+			"# TYPE runs counter\nruns{instance=\"1\",job=\"ci\"} 1\nruns{instance=\"2\",job=\"ci\"} 1\nruns{job=\"other\"} 1\n",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", PutReplaces: test.putReplaces})
+
+			for _, path := range []string{"/metrics/job/ci", "/metrics/job/other"} {
+				body := "# TYPE runs counter\nruns 1\n"
+				if path == "/metrics/job/ci" {
+					body = "# TYPE runs counter\nruns{instance=\"1\"} 1\nruns{instance=\"2\"} 1\n"
+				}
+				req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+				require.NoError(t, err)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				require.Equal(t, 202, w.Code)
+			}
+
+			req, err := http.NewRequest(test.method, test.path, bytes.NewBufferString("# TYPE runs counter\nruns{instance=\"1\"} 1\n"))
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.statusCode, w.Code)
+
+			req, err = http.NewRequest("GET", "/metrics", nil)
+			require.NoError(t, err)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+func TestIdempotencyRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", IdempotencyTTL: time.Minute, IdempotencyMaxKeys: 10})
+
+	push := func(path, key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := push("/metrics/job/browser", "first", "# TYPE clicks counter\nclicks 1\n")
+	assert.Equal(t, 202, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	w = push("/metrics/job/browser", "first", "# TYPE clicks counter\nclicks 1\n")
+	assert.Equal(t, 202, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+	w = push("/metrics/job/browser", "first", "# TYPE clicks counter\nclicks 2\n")
+	assert.Equal(t, 422, w.Code)
+	assert.Equal(t, "idempotency key was already used for a different push\n", w.Body.String())
+
+	w = push("/metrics/job/browser", "second", "# TYPE clicks gauge\nclicks 1\n")
+	assert.Equal(t, 400, w.Code)
+	w = push("/metrics/job/browser", "second", "# TYPE clicks gauge\nclicks 1\n")
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "cannot merge metric 'clicks': type COUNTER != GAUGE\n", w.Body.String())
+
+	w = push("/metrics/job/browser", strings.Repeat("k", 256), "# TYPE clicks counter\nclicks 1\n")
+	assert.Equal(t, 400, w.Code)
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "# TYPE clicks counter\nclicks{job=\"browser\"} 1\n", w.Body.String())
+}
+
+func TestIdempotencyRetryAfterMemoryLimitRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain:         "*",
+		TokensFile:         writeTokens(t, testTokensFile),
+		IdempotencyTTL:     time.Minute,
+		IdempotencyMaxKeys: 10,
+		MemorySoftLimit:    1,
+	})
+
+	request := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, 202, request("POST", "/metrics/job/old", "", "# TYPE clicks counter\nclicks 1\n").Code)
+
+	// new series are rejected past the soft limit
+	w := request("POST", "/metrics/job/browser", "retry", "# TYPE clicks counter\nclicks 1\n")
+	assert.Equal(t, 507, w.Code)
+
+	// so once memory is freed, the retry is merged rather than replayed
+	require.Equal(t, 202, request("DELETE", "/metrics/job/old", "", "").Code)
+	w = request("POST", "/metrics/job/browser", "retry", "# TYPE clicks counter\nclicks 1\n")
+	assert.Equal(t, 202, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	w = request("GET", "/metrics", "", "")
+	assert.Equal(t, "# TYPE clicks counter\nclicks{job=\"browser\"} 1\n", w.Body.String())
+}
+
+func TestLabelConflictRouter(t *testing.T) {
+	tests := []struct {
+		policy     metrics.LabelConflictPolicy
+		statusCode int
+		expected   string
+	}{
+		{metrics.LabelConflictReject, 400, ""},
+		{metrics.LabelConflictPathWins, 202, "# TYPE runs counter\nruns{job=\"path\"} 1\n"},
+		{metrics.LabelConflictBodyWins, 202, "# TYPE runs counter\nruns{job=\"body\"} 1\n"},
+		{metrics.LabelConflictRename, 202, "# TYPE runs counter\nruns{exported_job=\"body\",job=\"path\"} 1\n"},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.policy), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", LabelConflictPolicy: test.policy})
+
+			req, err := http.NewRequest("POST", "/metrics/job/path", bytes.NewBufferString("# TYPE runs counter\nruns{job=\"body\"} 1\n"))
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.statusCode, w.Code)
+
+			req, err = http.NewRequest("GET", "/metrics", nil)
+			require.NoError(t, err)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+func TestLabelConflictJobPolicyRouter(t *testing.T) {
+	tests := []struct {
+		policy     metrics.LabelConflictPolicy
+		path       string
+		statusCode int
+		body       string
+	}{
+		{metrics.LabelConflictBodyWins, "/metrics/job/ci", 403, "push to job \"other\" is not allowed\n"},
+		{metrics.LabelConflictPathWins, "/metrics/job/ci", 202, ""},
+		{metrics.LabelConflictRename, "/metrics/job/ci", 202, ""},
+		// a push without a job in the path is refused before its series are
+		// checked
+		{metrics.LabelConflictPathWins, "/metrics", 403, "push to job \"\" is not allowed\n"},
+	}
+
+	tokensFile := writeTokens(t, testTokensFile)
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s %s", idx+1, test.policy, test.path), func(t *testing.T) {
+			router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", TokensFile: tokensFile, LabelConflictPolicy: test.policy})
+
+			// the ci token may only push to the ci job
+			req, err := http.NewRequest("POST", test.path, bytes.NewBufferString("# TYPE ci_runs_total counter\nci_runs_total{job=\"other\"} 1\n"))
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer ci-secret")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.statusCode, w.Code)
+			assert.Equal(t, test.body, w.Body.String())
+		})
+	}
+}
+
+func TestRequestLabelsRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain:   "*",
+		QueryLabels:  []string{"app"},
+		HeaderLabels: map[string]string{"X-App-Version": "app_version"},
+	})
+
+	req, err := http.NewRequest("POST", "/metrics/job/browser?app=shop&user=1234", bytes.NewBufferString("# TYPE clicks counter\nclicks 1\n"))
+	require.NoError(t, err)
+	req.Header.Set("X-App-Version", "1.2.3")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "# TYPE clicks counter\nclicks{app=\"shop\",app_version=\"1.2.3\",job=\"browser\"} 1\n", w.Body.String())
+}
+
+func TestEnrichmentsRouter(t *testing.T) {
+	enrichments, err := metrics.ParseEnrichments([]string{"user_agent_family=browser:Chrome|Firefox", "user_agent_os=os"}, "")
+	require.NoError(t, err)
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain:  "*",
+		Enrichments: enrichments,
+	})
+
+	for _, ua := range []string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15",
+	} {
+		// the enriched labels replace any the client sends
+		req, err := http.NewRequest("POST", "/metrics/job/web/browser/spoofed", bytes.NewBufferString("# TYPE clicks counter\nclicks 1\n"))
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "# TYPE clicks counter\nclicks{browser=\"Firefox\",job=\"web\",os=\"Linux\"} 1\nclicks{browser=\"other\",job=\"web\",os=\"macOS\"} 1\n", w.Body.String())
+}
+
+func TestPutReplacesEnrichedRouter(t *testing.T) {
+	enrichments, err := metrics.ParseEnrichments([]string{"user_agent_family=browser:Chrome|Firefox"}, "")
+	require.NoError(t, err)
+	router := setupTestRouter(ApiRouterConfig{
+		CorsDomain:  "*",
+		PutReplaces: true,
+		Enrichments: enrichments,
+	})
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	for _, job := range []string{"a", "b"} {
+		require.Equal(t, 202, request("POST", "/metrics/job/"+job, "# TYPE c_total counter\nc_total 1\n").Code)
+	}
+
+	// the enriched browser label doesn't count as a label to replace by
+	w := request("PUT", "/metrics", "# TYPE c_total counter\nc_total 1\n")
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "labels to replace series by are required\n", w.Body.String())
+
+	w = request("GET", "/metrics", "")
+	assert.Equal(t, "# TYPE c_total counter\nc_total{browser=\"Chrome\",job=\"a\"} 1\nc_total{browser=\"Chrome\",job=\"b\"} 1\n", w.Body.String())
+}
+
+func TestIngestQueueRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", IngestQueueSize: 10, IngestWorkers: 2})
+
+	push := func(body string) int {
+		req, err := http.NewRequest("POST", "/metrics/job/web", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 202, push("# TYPE clicks counter\nclicks 1\n"))
+	}
+	// invalid pushes are still rejected before being queued
+	assert.Equal(t, 400, push("clicks{job=\"other\"} 1\n"))
+
+	assert.Eventually(t, func() bool {
+		req, err := http.NewRequest("GET", "/metrics", nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String() == "# TYPE clicks counter\nclicks{job=\"web\"} 5\n"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryBudgetRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*", MemorySoftLimit: 1})
+
+	push := func(body string) int {
+		req, err := http.NewRequest("POST", "/metrics/job/web", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, 202, push("# TYPE clicks counter\nclicks{button=\"buy\"} 1\n"))
+	// past the soft limit, series are still updated but not added
+	assert.Equal(t, 202, push("# TYPE clicks counter\nclicks{button=\"buy\"} 1\n"))
+	assert.Equal(t, 507, push("# TYPE clicks counter\nclicks{button=\"sell\"} 1\n"))
+	assert.Equal(t, 400, push("# TYPE clicks counter\nclicks{button=\"sell\",job=\"other\"} 1\n"))
+}
+
+func TestReady(t *testing.T) {
+	agg := metrics.NewAggregate(metrics.SetMemoryBudget(1, 0))
+	router := setupLifecycleRouter(prometheus.NewRegistry(), agg)
+
+	ready := func() ReadyResponse {
+		req, err := http.NewRequest("GET", "/ready", nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+
+		var response ReadyResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := ready()
+	assert.True(t, response.IsAlive)
+	assert.Equal(t, metrics.MemoryUsage{SoftLimitBytes: 1, State: "ok"}, response.Memory)
+
+	apiRouter, err := setupAPIRouter(ApiRouterConfig{CorsDomain: "*"}, agg, promMetrics.Config{Registry: prometheus.NewRegistry()})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "/metrics/job/web", bytes.NewBufferString("# TYPE clicks counter\nclicks 1\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	// the gateway stays ready past its limits
+	response = ready()
+	assert.Greater(t, response.Memory.UsedBytes, int64(0))
+	assert.Equal(t, "soft_limit", response.Memory.State)
+}
+
+func TestMatchRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+
+	req, err := http.NewRequest("POST", "/metrics/job/web", bytes.NewBufferString("# TYPE clicks counter\nclicks{button=\"buy\"} 1\nclicks{button=\"sell\"} 1\n# TYPE views counter\nviews 1\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	tests := []struct {
+		name       string
+		query      string
+		statusCode int
+		expected   string
+	}{
+		{
+			"single family",
+			"match[]=views",
+			200,
+			"# TYPE views counter\nviews{job=\"web\"} 1\n",
+		},
+		{
+			"series of several selectors",
+			"match[]=clicks{button%3D%22sell%22}&match[]=views",
+			200,
+			"# TYPE clicks counter\nclicks{button=\"sell\",job=\"web\"} 1\n# TYPE views counter\nviews{job=\"web\"} 1\n",
+		},
+		{
+			"invalid selector",
+			"match[]=clicks{button}",
+			400,
+			"invalid series selector \"clicks{button}\": expected one of =, !=, =~ or !~ after \"button\" at position 13\n",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/metrics?"+test.query, nil)
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, test.statusCode, w.Code)
+			assert.Equal(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+func TestScrapeShardRouter(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+
+	req, err := http.NewRequest("POST", "/metrics/job/web", bytes.NewBufferString("# TYPE clicks counter\nclicks{button=\"buy\"} 1\nclicks{button=\"sell\"} 1\n# TYPE views counter\nviews 1\n# TYPE errors counter\nerrors 1\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	scrape := func(query string) (int, string) {
+		req, err := http.NewRequest("GET", "/metrics?"+query, nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	for _, by := range []string{"family", "series"} {
+		var lines []string
+		for i := 0; i < 2; i++ {
+			code, body := scrape(fmt.Sprintf("shard=%d&shards=2&shardBy=%s", i, by))
+			require.Equal(t, 200, code)
+			for _, line := range strings.Split(body, "\n") {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					lines = append(lines, line)
+				}
+			}
+		}
+		// the shards render every series once between them
+		assert.ElementsMatch(t, []string{
+			"clicks{button=\"buy\",job=\"web\"} 1",
+			"clicks{button=\"sell\",job=\"web\"} 1",
+			"errors{job=\"web\"} 1",
+			"views{job=\"web\"} 1",
+		}, lines, by)
+	}
+
+	code, body := scrape("shard=2&shards=2")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "invalid scrape shard: shard must be an integer from 0 to 1, got \"2\"\n", body)
+}
+
 func TestCorsRouter(t *testing.T) {
 	tests := []struct {
 		name           string
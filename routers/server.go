@@ -15,20 +15,38 @@ func RunServers(cfg ApiRouterConfig, apiListen string, lifecycleListen string) {
 	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, syscall.SIGTERM, syscall.SIGINT)
 
-	agg := metrics.NewAggregate()
+	agg := metrics.NewAggregate(
+		metrics.SetPushLimits(cfg.PushLimits),
+		metrics.SetPartialPushes(cfg.PartialPushes),
+		metrics.SetTypeConflictPolicy(cfg.TypeConflictPolicy),
+		metrics.SetPutReplaces(cfg.PutReplaces),
+		metrics.SetIdempotency(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys),
+		metrics.SetLabelConflictPolicy(cfg.LabelConflictPolicy),
+		metrics.SetRequestLabels(cfg.QueryLabels, cfg.HeaderLabels),
+		metrics.SetEnrichments(cfg.Enrichments),
+		metrics.SetIngestQueue(cfg.IngestQueueSize, cfg.IngestWorkers),
+		metrics.SetMemoryBudget(cfg.MemorySoftLimit, cfg.MemoryHardLimit),
+	)
 
 	promMetricsConfig := promMetrics.Config{
 		Registry: metrics.PromRegistry,
 	}
 
-	apiRouter := setupAPIRouter(cfg, agg, promMetricsConfig)
+	apiRouter, err := setupAPIRouter(cfg, agg, promMetricsConfig)
+	if err != nil {
+		log.Fatalf("unable to setup api router: %v", err)
+	}
 	go runServer("api", apiRouter, apiListen)
 
-	lifecycleRouter := setupLifecycleRouter(metrics.PromRegistry)
+	lifecycleRouter := setupLifecycleRouter(metrics.PromRegistry, agg)
 	go runServer("lifecycle", lifecycleRouter, lifecycleListen)
 
 	// Block until an interrupt or term signal is sent
 	<-sigChannel
+
+	// queued pushes were already accepted, so they are merged before exiting
+	log.Println("shutting down, merging queued pushes")
+	agg.Close()
 }
 
 func runServer(label string, r *gin.Engine, listen string) {
@@ -0,0 +1,130 @@
+package routers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type scope string
+
+const (
+	scopePush   scope = "push"
+	scopeRead   scope = "read"
+	scopeDelete scope = "delete"
+)
+
+var validScopes = map[scope]struct{}{
+	scopePush:   {},
+	scopeRead:   {},
+	scopeDelete: {},
+}
+
+// apiToken is a bearer token or API key along with what it is allowed to do.
+// Empty Jobs or MetricPrefixes lists allow every job or metric.
+type apiToken struct {
+	Name           string   `yaml:"name"`
+	Token          string   `yaml:"token"`
+	Scopes         []scope  `yaml:"scopes"`
+	Jobs           []string `yaml:"jobs"`
+	MetricPrefixes []string `yaml:"metricPrefixes"`
+
+	digest [sha256.Size]byte
+}
+
+func (t *apiToken) hasScope(s scope) bool {
+	for _, have := range t.Scopes {
+		if have == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowJob implements metrics.PushPolicy
+func (t *apiToken) AllowJob(job string) bool {
+	if len(t.Jobs) == 0 {
+		return true
+	}
+	for _, allowed := range t.Jobs {
+		if allowed == job {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowFamily implements metrics.PushPolicy
+func (t *apiToken) AllowFamily(name string) bool {
+	if len(t.MetricPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range t.MetricPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenFile struct {
+	Tokens []*apiToken `yaml:"tokens"`
+}
+
+// tokenStore holds the tokens loaded from a token file
+type tokenStore struct {
+	tokens []*apiToken
+}
+
+func loadTokenStore(path string) (*tokenStore, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	seen := map[string]struct{}{}
+	for idx, t := range file.Tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: token #%d has no name", path, idx+1)
+		}
+		if _, duplicate := seen[t.Name]; duplicate {
+			return nil, fmt.Errorf("%s: duplicate token name %s", path, t.Name)
+		}
+		seen[t.Name] = struct{}{}
+
+		if t.Token == "" {
+			return nil, fmt.Errorf("%s: token %s has an empty value", path, t.Name)
+		}
+		for _, s := range t.Scopes {
+			if _, ok := validScopes[s]; !ok {
+				return nil, fmt.Errorf("%s: token %s has unknown scope %q", path, t.Name, s)
+			}
+		}
+		t.digest = sha256.Sum256([]byte(t.Token))
+	}
+
+	return &tokenStore{tokens: file.Tokens}, nil
+}
+
+// lookup finds the token matching value. Every token is compared so the
+// time taken does not depend on which one matched.
+func (ts *tokenStore) lookup(value string) *apiToken {
+	digest := sha256.Sum256([]byte(value))
+
+	var found *apiToken
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare(digest[:], t.digest[:]) == 1 {
+			found = t
+		}
+	}
+	return found
+}
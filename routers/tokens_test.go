@@ -0,0 +1,78 @@
+package routers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTokensFile = `
+tokens:
+  - name: ci
+    token: ci-secret
+    scopes: [push]
+    jobs: [ci]
+    metricPrefixes: [ci_, build_]
+  - name: prometheus
+    token: scrape-secret
+    scopes: [read]
+  - name: admin
+    token: admin-secret
+    scopes: [push, read, delete]
+`
+
+func writeTokens(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadTokenStore(t *testing.T) {
+	store, err := loadTokenStore(writeTokens(t, testTokensFile))
+	require.NoError(t, err)
+
+	ci := store.lookup("ci-secret")
+	require.NotNil(t, ci)
+	assert.Equal(t, "ci", ci.Name)
+	assert.True(t, ci.hasScope(scopePush))
+	assert.False(t, ci.hasScope(scopeRead))
+
+	assert.Nil(t, store.lookup("wrong"))
+	assert.Nil(t, store.lookup(""))
+}
+
+func TestLoadTokenStoreErrors(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"missing name", "tokens:\n  - token: abc\n"},
+		{"empty token", "tokens:\n  - name: a\n"},
+		{"duplicate name", "tokens:\n  - name: a\n    token: b\n  - name: a\n    token: c\n"},
+		{"unknown scope", "tokens:\n  - name: a\n    token: b\n    scopes: [write]\n"},
+		{"invalid yaml", "tokens: [\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTokenStore(writeTokens(t, test.content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestApiTokenPolicy(t *testing.T) {
+	scoped := &apiToken{Jobs: []string{"ci"}, MetricPrefixes: []string{"ci_", "build_"}}
+	assert.True(t, scoped.AllowJob("ci"))
+	assert.False(t, scoped.AllowJob("other"))
+	assert.False(t, scoped.AllowJob(""))
+	assert.True(t, scoped.AllowFamily("ci_runs_total"))
+	assert.True(t, scoped.AllowFamily("build_seconds"))
+	assert.False(t, scoped.AllowFamily("http_requests_total"))
+
+	unscoped := &apiToken{}
+	assert.True(t, unscoped.AllowJob(""))
+	assert.True(t, unscoped.AllowFamily("anything"))
+}